@@ -0,0 +1,183 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/NikosGour/logging/src"
+)
+
+var (
+	ErrAuthenticationFailed = errors.New("Authentication failed, wrong pre-shared key")
+	ErrAuthRateLimited      = errors.New("Too many failed authentications, try again later")
+)
+
+const (
+	AUTH_CHALLENGE_SIZE = 32
+	AUTH_BACKOFF        = 1 * time.Second
+	MAX_AUTH_BACKOFF    = 5 * time.Minute
+
+	auth_label    = "BigDownloadP2P pre-shared key\x00"
+	auth_accepted = byte(1)
+	auth_rejected = byte(0)
+)
+
+func authResponse(key []byte, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(auth_label))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// authenticate answers the receiver's challenge with the pre-shared key.
+func authenticate(conn io.ReadWriter, key []byte) error {
+	challenge := make([]byte, AUTH_CHALLENGE_SIZE)
+	_, err := io.ReadFull(conn, challenge)
+	if errors.Is(err, io.EOF) {
+		// The receiver hangs up on a backed off sender
+		return ErrAuthRateLimited
+	}
+	if err != nil {
+		return fmt.Errorf("On read challenge: %w", err)
+	}
+	_, err = conn.Write(authResponse(key, challenge))
+	if err != nil {
+		return fmt.Errorf("On write response: %w", err)
+	}
+
+	status := make([]byte, 1)
+	_, err = io.ReadFull(conn, status)
+	if err != nil || status[0] != auth_accepted {
+		return ErrAuthenticationFailed
+	}
+	return nil
+}
+
+// challenge makes the sender prove it has the pre-shared key.
+func (conn *Conn) challenge(key []byte) error {
+	challenge := make([]byte, AUTH_CHALLENGE_SIZE)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return fmt.Errorf("On random challenge: %w", err)
+	}
+	_, err = conn.Write(challenge)
+	if err != nil {
+		return fmt.Errorf("On write challenge: %w", err)
+	}
+
+	response := make([]byte, sha256.Size)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return fmt.Errorf("On read response: %w", err)
+	}
+	if !hmac.Equal(response, authResponse(key, challenge)) {
+		conn.Write([]byte{auth_rejected})
+		return ErrAuthenticationFailed
+	}
+
+	_, err = conn.Write([]byte{auth_accepted})
+	if err != nil {
+		return fmt.Errorf("On write status: %w", err)
+	}
+	return nil
+}
+
+// authLimiter backs off the hosts that fail to authenticate, doubling the wait
+// after every failure up to MAX_AUTH_BACKOFF.
+type authLimiter struct {
+	hosts map[string]*authFailures
+	mu    sync.Mutex
+}
+
+type authFailures struct {
+	count         int
+	blocked_until time.Time
+}
+
+func (al *authLimiter) blocked(host string) bool {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	failures, ok := al.hosts[host]
+	return ok && time.Now().Before(failures.blocked_until)
+}
+
+func (al *authLimiter) failed(host string) (int, time.Duration) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.hosts == nil {
+		al.hosts = map[string]*authFailures{}
+	}
+	failures, ok := al.hosts[host]
+	if !ok {
+		failures = &authFailures{}
+		al.hosts[host] = failures
+	}
+	failures.count++
+
+	backoff := MAX_AUTH_BACKOFF
+	if failures.count < 20 {
+		backoff = min(AUTH_BACKOFF<<(failures.count-1), MAX_AUTH_BACKOFF)
+	}
+	failures.blocked_until = time.Now().Add(backoff)
+	return failures.count, backoff
+}
+
+func (al *authLimiter) succeeded(host string) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	delete(al.hosts, host)
+}
+
+// authenticate challenges a new connection for the pre-shared key, unless
+// its host is still backed off from failing before.
+func (l *Listener) authenticate(conn *Conn) error {
+	addr := conn.remoteAddr()
+	host := conn.remoteHost()
+
+	if l.auth_limiter.blocked(host) {
+		log.Warn("Refusing `%s`, too many failed authentications", addr)
+		return ErrAuthRateLimited
+	}
+
+	err := conn.challenge(l.PreSharedKey)
+	if errors.Is(err, ErrAuthenticationFailed) {
+		count, backoff := l.auth_limiter.failed(host)
+		log.Warn("Failed authentication from `%s` (%d in a row), refusing it for %s", addr, count, backoff)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	l.auth_limiter.succeeded(host)
+	return nil
+}
+
+// remoteAddr returns the address of the peer, or "" if it isn't on a network.
+func (conn *Conn) remoteAddr() string {
+	net_conn, ok := conn.c.(net.Conn)
+	if !ok {
+		return ""
+	}
+	return net_conn.RemoteAddr().String()
+}
+
+// remoteHost returns the address of the peer without its port.
+func (conn *Conn) remoteHost() string {
+	addr := conn.remoteAddr()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -1,26 +1,90 @@
 package cli
 
 import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/NikosGour/BigDownloadP2P/app"
 	log "github.com/NikosGour/logging/src"
 )
 
 func Start() {
 
-	port, is_receiver, address, output_dir, files, err := commandLineArgs()
+	args, err := commandLineArgs()
 	if err != nil {
 		log.Fatal("%s", err)
 	}
 
-	if is_receiver {
-		l := app.NewListener(port, output_dir)
+	var identity *app.Identity
+	var known_peers *app.KnownPeers
+	if args.secure {
+		config_dir, err := app.DefaultConfigDir()
+		if err != nil {
+			log.Fatal("%s", err)
+		}
+		identity, err = app.LoadOrCreateIdentity(config_dir)
+		if err != nil {
+			log.Fatal("%s", err)
+		}
+		known_peers, err = app.LoadKnownPeers(filepath.Join(config_dir, app.KNOWN_PEERS_FILE))
+		if err != nil {
+			log.Fatal("%s", err)
+		}
+	}
+
+	if args.is_receiver {
+		l := app.NewListener(args.port, args.output_dir)
+		if args.unix != "" {
+			l.Transport = app.UnixTransport{}
+			l.Address = args.unix
+		}
+		if args.rendezvous != "" {
+			l.Transport = app.PunchTransport{Rendezvous: args.rendezvous, SimulateNAT: args.simulate_nat}
+			l.Address = args.name
+		}
+		l.PreserveMetadata = !args.no_preserve
+		l.Identity = identity
+		l.PreSharedKey = []byte(args.key)
+		l.AutoAccept = args.auto_accept
+		l.MaxSize = args.max_size
+		l.AllowedPeers = args.allow
+		l.Prompt = promptOffer
+		l.JSONFrames = args.json_frames
+		if args.pair {
+			l.PairingCode, err = app.NewPairingCode()
+			if err != nil {
+				log.Fatal("%s", err)
+			}
+			log.Info("Pairing code: %s", l.PairingCode)
+		}
 		err = l.Listen()
 	} else {
-		log.Debug("files=%v", files)
-		fs := app.NewFileSender(port, address)
+		log.Debug("files=%v", args.files)
+		fs := app.NewFileSender(args.port, args.address)
+		if args.unix != "" {
+			fs = app.NewTransportFileSender(app.UnixTransport{}, args.unix)
+		}
+		if args.rendezvous != "" {
+			fs = app.NewTransportFileSender(app.PunchTransport{Rendezvous: args.rendezvous, SimulateNAT: args.simulate_nat}, args.name)
+		}
+		fs.Parts = args.parts
+		fs.HashAlgorithm = args.hash
+		fs.Symlinks = args.symlinks
+		fs.Compression = args.compression
+		fs.CompressionLevel = args.level
+		fs.Identity = identity
+		fs.KnownPeers = known_peers
+		fs.Fingerprint = args.fingerprint
+		fs.PairingCode = args.code
+		fs.PreSharedKey = []byte(args.key)
+		fs.JSONFrames = args.json_frames
+		fs.Multiplex = args.multiplex
 		defer fs.Close()
 
-		err = fs.SendFiles(files)
+		err = fs.SendFiles(args.files)
 		// err = fs.SendString("nikos")
 	}
 
@@ -28,3 +92,38 @@ func Start() {
 		log.Fatal("%s", err)
 	}
 }
+
+// MAX_PROMPT_FILES is how many files of an offer are listed when asking about it.
+const MAX_PROMPT_FILES = 10
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// promptOffer asks on the terminal whether to accept an offer, anything but a
+// yes declines it.
+func promptOffer(offer app.OfferJSON) bool {
+	size, unit := app.BestUnitOfData(int(offer.TotalSize()))
+	fmt.Printf("\n`%s` from %s wants to send %d files, %.2f %s:\n", offer.Name, offer.Peer, offer.FileCount(), size, unit)
+	for i, file_info := range offer.Files {
+		if i == MAX_PROMPT_FILES {
+			fmt.Printf("\t... and %d more\n", len(offer.Files)-i)
+			break
+		}
+		switch {
+		case file_info.IsDir:
+			fmt.Printf("\t%s/\n", file_info.Path)
+		case file_info.LinkTarget != "":
+			fmt.Printf("\t%s -> %s\n", file_info.Path, file_info.LinkTarget)
+		default:
+			fmt.Printf("\t%s (%d bytes)\n", file_info.Path, file_info.Size)
+		}
+	}
+	fmt.Print("Accept? [y/N] ")
+
+	answer, err := stdin.ReadString('\n')
+	if err != nil {
+		fmt.Println()
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -4,43 +4,253 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"os"
+	"strings"
+
+	"github.com/NikosGour/BigDownloadP2P/app"
 )
 
+// PRE_SHARED_KEY_ENV holds the pre-shared key when no flag gives one.
+const PRE_SHARED_KEY_ENV = "BIGDOWNLOADP2P_KEY"
+
 var (
-	ErrAppCommandLineArgsNoFilesProvided = errors.New("No files were provided through arguments")
+	ErrAppCommandLineArgsNoFilesProvided   = errors.New("No files were provided through arguments")
+	ErrAppCommandLineArgsInvalidParts      = errors.New("Number of parts can't be negative")
+	ErrAppCommandLineArgsTooManyKeys       = errors.New("Only one of --key and --key_file can be given")
+	ErrAppCommandLineArgsEmptyKey          = errors.New("The key file is empty")
+	ErrAppCommandLineArgsNoRendezvousName  = errors.New("A rendezvous needs a name to register as")
+	ErrAppCommandLineArgsTooManyTransports = errors.New("Only one of --unix and --rendezvous can be given")
 )
 
-func commandLineArgs() (port int, is_receiver bool, address string, output_dir string, files []string, err error) {
+type cliArgs struct {
+	port         int
+	is_receiver  bool
+	address      string
+	unix         string
+	rendezvous   string
+	name         string
+	simulate_nat bool
+	output_dir   string
+	parts        int
+	hash         app.HashAlgorithm
+	no_preserve  bool
+	symlinks     app.SymlinkPolicy
+	compression  app.Compression
+	level        int
+	secure       bool
+	fingerprint  string
+	pair         bool
+	code         string
+	key          string
+	auto_accept  bool
+	multiplex    bool
+	json_frames  bool
+	max_size     int64
+	allow        []string
+	files        []string
+}
+
+func commandLineArgs() (args cliArgs, err error) {
 	const usage = `Usage: BigDownloadP2P [OPTIONS] [FILES]
 Files:
 	You can pass space seperated file paths at the end of the command to send to the address. E.g. BigDownloadP2P -p 4444 ./a.txt ./b.log ./c.exe
+	Directories are sent with everything in them. E.g. BigDownloadP2P -p 4444 ./build
 Options:
 		-p | --port		Define the port for the client to use (default: 6969)
 		-r | --is_receiver	Toggle if the client is a sender or a receiver (default: sender)
 		-a | --address	The destination ip address (default: localhost)
+		-u | --unix	Connect over the Unix socket at this path instead of TCP, both ends need it
+		-R | --rendezvous	Punch through NATs with the help of the rendezvous at this host:port, both ends need it
+		-i | --id	The name both ends register as at the rendezvous, in place of the address
+		-S | --simulate_nat	Act as if behind a NAT, to try punching on one machine (default: false)
 		-o | --output_dir The dir where or the downloads will be placed (default: pwd)
+		-n | --parts	The number of parts each file is split into, 0 picks it by file size (default: 0)
+		-H | --hash	The hash used to verify the files: sha256, xxh64 or blake3 (default: sha256)
+		-N | --no_preserve	Don't apply the sender's permissions and mod times to the downloads (default: false)
+		-L | --symlinks	What to do with symlinks inside directories: preserve, follow or skip (default: preserve)
+		-c | --compression	Compress the parts that compress well: none, zstd or gzip (default: none)
+		-l | --level	The compression level, 0 picks the default of the compression (default: 0)
+		-s | --secure	Encrypt the connections with TLS, both ends need it (default: false)
+		-f | --fingerprint	The fingerprint the receiver printed, to pin it the first time (default: trust on first use)
+		-P | --pair	Print a pairing code senders have to give to send files (default: false)
+		-k | --code	The pairing code the receiver printed
+		-K | --key	The pre-shared key the sender has to prove it has, both ends need it (default: $BIGDOWNLOADP2P_KEY)
+		-F | --key_file	A file with the pre-shared key
+		-y | --auto-accept	Accept the transfers that pass --max-size and --allow without asking (default: false)
+		-m | --max-size	Decline the transfers bigger than this, e.g. 10GiB, 0 has no limit (default: 0)
+		-A | --allow	Comma separated hosts or fingerprints to accept transfers from (default: anyone)
+		-M | --multiplex	Send everything over one connection instead of one per part (default: false)
+		-J | --json_frames	Send every message as JSON instead of binary, for debugging (default: false)
 		`
 
-	flag.IntVar(&port, "p", 6969, "The port for the client to use")
-	flag.IntVar(&port, "port", 6969, "The port for the client to use")
+	flag.IntVar(&args.port, "p", 6969, "The port for the client to use")
+	flag.IntVar(&args.port, "port", 6969, "The port for the client to use")
+
+	flag.BoolVar(&args.is_receiver, "r", false, "Will toggle the client to receive instead of send files")
+	flag.BoolVar(&args.is_receiver, "is_receiver", false, "Will toggle the client to receive instead of send files")
+
+	flag.StringVar(&args.address, "a", "localhost", "The ip address to send the files to")
+	flag.StringVar(&args.address, "address", "localhost", "The ip address to send the files to")
+
+	flag.StringVar(&args.unix, "u", "", "Connect over the Unix socket at this path instead of TCP")
+	flag.StringVar(&args.unix, "unix", "", "Connect over the Unix socket at this path instead of TCP")
+
+	flag.StringVar(&args.rendezvous, "R", "", "Punch through NATs with the help of the rendezvous at this host:port")
+	flag.StringVar(&args.rendezvous, "rendezvous", "", "Punch through NATs with the help of the rendezvous at this host:port")
+
+	flag.StringVar(&args.name, "i", "", "The name both ends register as at the rendezvous")
+	flag.StringVar(&args.name, "id", "", "The name both ends register as at the rendezvous")
+
+	flag.BoolVar(&args.simulate_nat, "S", false, "Act as if behind a NAT")
+	flag.BoolVar(&args.simulate_nat, "simulate_nat", false, "Act as if behind a NAT")
+
+	flag.StringVar(&args.output_dir, "o", "", "The output directory to place the downloads")
+	flag.StringVar(&args.output_dir, "output_dir", "", "The output directory to place the downloads")
+
+	flag.IntVar(&args.parts, "n", 0, "The number of parts each file is split into")
+	flag.IntVar(&args.parts, "parts", 0, "The number of parts each file is split into")
+
+	flag.BoolVar(&args.no_preserve, "N", false, "Don't apply the sender's permissions and mod times to the downloads")
+	flag.BoolVar(&args.no_preserve, "no_preserve", false, "Don't apply the sender's permissions and mod times to the downloads")
+
+	var hash string
+	flag.StringVar(&hash, "H", string(app.DEFAULT_HASH_ALGORITHM), "The hash used to verify the files")
+	flag.StringVar(&hash, "hash", string(app.DEFAULT_HASH_ALGORITHM), "The hash used to verify the files")
+
+	var symlinks string
+	flag.StringVar(&symlinks, "L", string(app.DEFAULT_SYMLINK_POLICY), "What to do with symlinks inside directories")
+	flag.StringVar(&symlinks, "symlinks", string(app.DEFAULT_SYMLINK_POLICY), "What to do with symlinks inside directories")
 
-	flag.BoolVar(&is_receiver, "r", false, "Will toggle the client to receive instead of send files")
-	flag.BoolVar(&is_receiver, "is_receiver", false, "Will toggle the client to receive instead of send files")
+	var compression string
+	flag.StringVar(&compression, "c", string(app.DEFAULT_COMPRESSION), "Compress the parts that compress well")
+	flag.StringVar(&compression, "compression", string(app.DEFAULT_COMPRESSION), "Compress the parts that compress well")
 
-	flag.StringVar(&address, "a", "localhost", "The ip address to send the files to")
-	flag.StringVar(&address, "address", "localhost", "The ip address to send the files to")
+	flag.IntVar(&args.level, "l", 0, "The compression level")
+	flag.IntVar(&args.level, "level", 0, "The compression level")
 
-	flag.StringVar(&output_dir, "o", "", "The output directory to place the downloads")
-	flag.StringVar(&output_dir, "output_dir", "", "The output directory to place the downloads")
+	flag.BoolVar(&args.secure, "s", false, "Encrypt the connections with TLS")
+	flag.BoolVar(&args.secure, "secure", false, "Encrypt the connections with TLS")
+
+	flag.StringVar(&args.fingerprint, "f", "", "The fingerprint the receiver printed")
+	flag.StringVar(&args.fingerprint, "fingerprint", "", "The fingerprint the receiver printed")
+
+	flag.BoolVar(&args.pair, "P", false, "Print a pairing code senders have to give")
+	flag.BoolVar(&args.pair, "pair", false, "Print a pairing code senders have to give")
+
+	flag.StringVar(&args.code, "k", "", "The pairing code the receiver printed")
+	flag.StringVar(&args.code, "code", "", "The pairing code the receiver printed")
+
+	var key_file string
+	flag.StringVar(&args.key, "K", "", "The pre-shared key the sender has to prove it has")
+	flag.StringVar(&args.key, "key", "", "The pre-shared key the sender has to prove it has")
+	flag.StringVar(&key_file, "F", "", "A file with the pre-shared key")
+	flag.StringVar(&key_file, "key_file", "", "A file with the pre-shared key")
+
+	flag.BoolVar(&args.auto_accept, "y", false, "Accept the transfers that pass --max-size and --allow without asking")
+	flag.BoolVar(&args.auto_accept, "auto-accept", false, "Accept the transfers that pass --max-size and --allow without asking")
+
+	flag.BoolVar(&args.multiplex, "M", false, "Send everything over one connection instead of one per part")
+	flag.BoolVar(&args.multiplex, "multiplex", false, "Send everything over one connection instead of one per part")
+
+	flag.BoolVar(&args.json_frames, "J", false, "Send every message as JSON instead of binary")
+	flag.BoolVar(&args.json_frames, "json_frames", false, "Send every message as JSON instead of binary")
+
+	var max_size string
+	flag.StringVar(&max_size, "m", "0", "Decline the transfers bigger than this")
+	flag.StringVar(&max_size, "max-size", "0", "Decline the transfers bigger than this")
+
+	var allow string
+	flag.StringVar(&allow, "A", "", "Comma separated hosts or fingerprints to accept transfers from")
+	flag.StringVar(&allow, "allow", "", "Comma separated hosts or fingerprints to accept transfers from")
 
 	flag.Usage = func() { fmt.Println(usage) }
 	flag.Parse()
 
-	files = flag.Args()
-	if !is_receiver && len(files) == 0 {
+	args.hash, err = app.ParseHashAlgorithm(hash)
+	if err != nil {
+		return
+	}
+
+	args.symlinks, err = app.ParseSymlinkPolicy(symlinks)
+	if err != nil {
+		return
+	}
+
+	args.compression, err = app.ParseCompression(compression)
+	if err != nil {
+		return
+	}
+	err = args.compression.ValidateLevel(args.level)
+	if err != nil {
+		return
+	}
+
+	if args.code != "" {
+		args.code, err = app.ParsePairingCode(args.code)
+		if err != nil {
+			return
+		}
+	}
+
+	args.key, err = preSharedKey(args.key, key_file)
+	if err != nil {
+		return
+	}
+
+	args.max_size, err = app.ParseSize(max_size)
+	if err != nil {
+		return
+	}
+
+	for _, peer := range strings.Split(allow, ",") {
+		peer = strings.TrimSpace(peer)
+		if peer != "" {
+			args.allow = append(args.allow, peer)
+		}
+	}
+
+	if args.rendezvous != "" && args.name == "" {
+		err = ErrAppCommandLineArgsNoRendezvousName
+		return
+	}
+	if args.rendezvous != "" && args.unix != "" {
+		err = ErrAppCommandLineArgsTooManyTransports
+		return
+	}
+
+	if args.parts < 0 {
+		err = ErrAppCommandLineArgsInvalidParts
+		return
+	}
+
+	args.files = flag.Args()
+	if !args.is_receiver && len(args.files) == 0 {
 		err = ErrAppCommandLineArgsNoFilesProvided
 		return
 	}
 
 	return
 }
+
+// preSharedKey picks the key from the flag, the key file or the environment, in
+// that order.
+func preSharedKey(key string, key_file string) (string, error) {
+	if key != "" && key_file != "" {
+		return "", ErrAppCommandLineArgsTooManyKeys
+	}
+	if key != "" {
+		return key, nil
+	}
+	if key_file != "" {
+		data, err := os.ReadFile(key_file)
+		if err != nil {
+			return "", fmt.Errorf("On read key file: %w", err)
+		}
+		key = strings.TrimSpace(string(data))
+		if key == "" {
+			return "", fmt.Errorf("%w: `%s`", ErrAppCommandLineArgsEmptyKey, key_file)
+		}
+		return key, nil
+	}
+	return os.Getenv(PRE_SHARED_KEY_ENV), nil
+}
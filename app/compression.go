@@ -0,0 +1,358 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	ErrUnknownCompression      = errors.New("Unknown compression")
+	ErrInvalidCompressionLevel = errors.New("Invalid compression level")
+	ErrInvalidCompressedBlock  = errors.New("Invalid compressed block")
+	ErrUnsupportedCompression  = errors.New("Compression isn't supported")
+)
+
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionZstd Compression = "zstd"
+	CompressionGzip Compression = "gzip"
+
+	DEFAULT_COMPRESSION = CompressionNone
+)
+
+// SUPPORTED_COMPRESSIONS is what a Listener accepts unless told otherwise.
+var SUPPORTED_COMPRESSIONS = []Compression{CompressionZstd, CompressionGzip}
+
+// Part bodies are compressed in blocks, each sent as its compressed length
+// followed by the compressed bytes, so the receiver never reads past the body.
+const (
+	COMPRESSION_BLOCK_SIZE     = int(1 * MiB)
+	MAX_COMPRESSED_BLOCK_SIZE  = 2 * COMPRESSION_BLOCK_SIZE
+	COMPRESSION_SAMPLES        = 8
+	COMPRESSION_SAMPLE_SIZE    = 64 * KiB
+	COMPRESSION_MAX_RATIO      = 0.9
+	MAX_ZSTD_COMPRESSION_LEVEL = 22
+)
+
+func ParseCompression(name string) (Compression, error) {
+	switch compression := Compression(name); compression {
+	case CompressionNone, CompressionZstd, CompressionGzip:
+		return compression, nil
+	case "":
+		return CompressionNone, nil
+	default:
+		return "", fmt.Errorf("%w: `%s`", ErrUnknownCompression, name)
+	}
+}
+
+func (c Compression) isNone() bool {
+	return c == "" || c == CompressionNone
+}
+
+// ValidateLevel checks that `level` is a level of `c`.
+func (c Compression) ValidateLevel(level int) error {
+	if c.isNone() {
+		return nil
+	}
+	codec, err := c.newCodec(level)
+	if err != nil {
+		return err
+	}
+	codec.Close()
+	return nil
+}
+
+// blockCodec compresses and decompresses whole blocks.
+type blockCodec interface {
+	compress(dst []byte, src []byte) ([]byte, error)
+	decompress(dst []byte, src []byte) ([]byte, error)
+	Close()
+}
+
+// newCodec returns the codec of `c`, a `level` of 0 picks the default level.
+func (c Compression) newCodec(level int) (blockCodec, error) {
+	switch c {
+	case CompressionZstd:
+		if level < 0 || level > MAX_ZSTD_COMPRESSION_LEVEL {
+			return nil, fmt.Errorf("%w: %d for %s", ErrInvalidCompressionLevel, level, c)
+		}
+		encoder_level := zstd.SpeedDefault
+		if level > 0 {
+			encoder_level = zstd.EncoderLevelFromZstd(level)
+		}
+
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encoder_level), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("On zstd encoder: %w", err)
+		}
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(COMPRESSION_BLOCK_SIZE)))
+		if err != nil {
+			enc.Close()
+			return nil, fmt.Errorf("On zstd decoder: %w", err)
+		}
+		return &zstdCodec{enc: enc, dec: dec}, nil
+	case CompressionGzip:
+		if level < 0 || level > gzip.BestCompression {
+			return nil, fmt.Errorf("%w: %d for %s", ErrInvalidCompressionLevel, level, c)
+		}
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return &gzipCodec{level: level}, nil
+	default:
+		return nil, fmt.Errorf("%w: `%s`", ErrUnknownCompression, c)
+	}
+}
+
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func (zc *zstdCodec) compress(dst []byte, src []byte) ([]byte, error) {
+	return zc.enc.EncodeAll(src, dst[:0]), nil
+}
+
+func (zc *zstdCodec) decompress(dst []byte, src []byte) ([]byte, error) {
+	block, err := zc.dec.DecodeAll(src, dst[:0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCompressedBlock, err)
+	}
+	return block, nil
+}
+
+func (zc *zstdCodec) Close() {
+	zc.enc.Close()
+	zc.dec.Close()
+}
+
+type gzipCodec struct {
+	level int
+	w     *gzip.Writer
+	r     *gzip.Reader
+}
+
+func (gc *gzipCodec) compress(dst []byte, src []byte) ([]byte, error) {
+	out := bytes.NewBuffer(dst[:0])
+	if gc.w == nil {
+		w, err := gzip.NewWriterLevel(out, gc.level)
+		if err != nil {
+			return nil, fmt.Errorf("On gzip writer: %w", err)
+		}
+		gc.w = w
+	} else {
+		gc.w.Reset(out)
+	}
+
+	_, err := gc.w.Write(src)
+	if err != nil {
+		return nil, fmt.Errorf("On gzip: %w", err)
+	}
+	err = gc.w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("On gzip: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+func (gc *gzipCodec) decompress(dst []byte, src []byte) ([]byte, error) {
+	var err error
+	if gc.r == nil {
+		gc.r, err = gzip.NewReader(bytes.NewReader(src))
+	} else {
+		err = gc.r.Reset(bytes.NewReader(src))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCompressedBlock, err)
+	}
+
+	// A block never decompresses to more than COMPRESSION_BLOCK_SIZE
+	out := bytes.NewBuffer(dst[:0])
+	n, err := io.Copy(out, io.LimitReader(gc.r, int64(COMPRESSION_BLOCK_SIZE)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCompressedBlock, err)
+	}
+	if n > int64(COMPRESSION_BLOCK_SIZE) {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrInvalidCompressedBlock, COMPRESSION_BLOCK_SIZE)
+	}
+	return out.Bytes(), nil
+}
+
+func (gc *gzipCodec) Close() {}
+
+// compressedStream compresses everything written to it and decompresses
+// everything read from it, block by block, over `rw`.
+type compressedStream struct {
+	rw    io.ReadWriter
+	codec blockCodec
+
+	write_block []byte
+	compressed  []byte
+	read_block  []byte
+	read_pos    int
+}
+
+func (cs *compressedStream) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := min(len(p), COMPRESSION_BLOCK_SIZE-len(cs.write_block))
+		cs.write_block = append(cs.write_block, p[:take]...)
+		p = p[take:]
+
+		if len(cs.write_block) == COMPRESSION_BLOCK_SIZE {
+			err := cs.Flush()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush sends what's left as a last, shorter block.
+func (cs *compressedStream) Flush() error {
+	if len(cs.write_block) == 0 {
+		return nil
+	}
+
+	compressed, err := cs.codec.compress(cs.compressed, cs.write_block)
+	if err != nil {
+		return err
+	}
+	cs.compressed = compressed
+	cs.write_block = cs.write_block[:0]
+
+	err = binary.Write(cs.rw, binary.BigEndian, int64(len(compressed)))
+	if err != nil {
+		return fmt.Errorf("On write block size: %w", err)
+	}
+	_, err = cs.rw.Write(compressed)
+	if err != nil {
+		return fmt.Errorf("On write block: %w", err)
+	}
+	return nil
+}
+
+func (cs *compressedStream) Read(p []byte) (int, error) {
+	if cs.read_pos == len(cs.read_block) {
+		err := cs.readBlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, cs.read_block[cs.read_pos:])
+	cs.read_pos += n
+	return n, nil
+}
+
+func (cs *compressedStream) readBlock() error {
+	var size int64
+	err := binary.Read(cs.rw, binary.BigEndian, &size)
+	if err != nil {
+		return err
+	}
+	if size <= 0 || size > int64(MAX_COMPRESSED_BLOCK_SIZE) {
+		return fmt.Errorf("%w: %d bytes", ErrInvalidCompressedBlock, size)
+	}
+
+	if int64(cap(cs.compressed)) < size {
+		cs.compressed = make([]byte, size)
+	}
+	cs.compressed = cs.compressed[:size]
+	_, err = io.ReadFull(cs.rw, cs.compressed)
+	if err != nil {
+		return fmt.Errorf("On read block: %w", err)
+	}
+
+	block, err := cs.codec.decompress(cs.read_block, cs.compressed)
+	if err != nil {
+		return err
+	}
+	if len(block) == 0 {
+		return fmt.Errorf("%w: empty", ErrInvalidCompressedBlock)
+	}
+	cs.read_block = block
+	cs.read_pos = 0
+	return nil
+}
+
+// Close flushes the last block, the underlying connection stays open.
+func (cs *compressedStream) Close() error {
+	err := cs.Flush()
+	cs.codec.Close()
+	return err
+}
+
+// bodyConn returns the Conn a part body goes through with `compression`, which
+// is `conn` itself when there is none. `done` must be called after the body.
+func (conn *Conn) bodyConn(compression Compression, level int) (*Conn, func() error, error) {
+	if compression.isNone() {
+		return conn, func() error { return nil }, nil
+	}
+
+	codec, err := compression.newCodec(level)
+	if err != nil {
+		return nil, nil, err
+	}
+	body := NewConn(&compressedStream{rw: conn, codec: codec})
+	return body, body.Close, nil
+}
+
+// compressible samples the data chunks of a part and reports whether
+// `compression` shrinks them enough to be worth it.
+func compressible(r io.ReaderAt, part_info FileInfoJSON, compression Compression, level int) (bool, error) {
+	codec, err := compression.newCodec(level)
+	if err != nil {
+		return false, err
+	}
+	defer codec.Close()
+
+	data_chunks := []int{}
+	for chunk := range numberOfChunks(part_info.Length, part_info.ChunkSize) {
+		if !part_info.isHoleChunk(chunk) {
+			data_chunks = append(data_chunks, chunk)
+		}
+	}
+	if len(data_chunks) == 0 {
+		return false, nil
+	}
+
+	raw_size := 0
+	compressed_size := 0
+	sample := make([]byte, COMPRESSION_SAMPLE_SIZE)
+	compressed := []byte{}
+	for i := range min(COMPRESSION_SAMPLES, len(data_chunks)) {
+		chunk := data_chunks[i*len(data_chunks)/min(COMPRESSION_SAMPLES, len(data_chunks))]
+		chunk_range := chunkRange(part_info, chunk)
+
+		n, err := r.ReadAt(sample[:min(COMPRESSION_SAMPLE_SIZE, chunk_range.Length)], chunk_range.Offset)
+		if err != nil && err != io.EOF {
+			return false, fmt.Errorf("On read sample: %w", err)
+		}
+		compressed, err = codec.compress(compressed, sample[:n])
+		if err != nil {
+			return false, err
+		}
+		raw_size += n
+		compressed_size += len(compressed)
+	}
+	return float64(compressed_size) <= COMPRESSION_MAX_RATIO*float64(raw_size), nil
+}
+
+// negotiateCompression picks `wanted` if both sides agreed on it.
+func negotiateCompression(wanted Compression, capabilities []Capability) Compression {
+	if wanted.isNone() || !slices.Contains(capabilities, compressionCapability(wanted)) {
+		return CompressionNone
+	}
+	return wanted
+}
@@ -0,0 +1,329 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/NikosGour/logging/src"
+)
+
+var (
+	ErrPartsMismatch       = errors.New("Number of parts doesn't match the download")
+	ErrPartAlreadyFinished = errors.New("Part is already finished")
+	ErrPartAlreadyActive   = errors.New("Part is already being received")
+	ErrInvalidResume       = errors.New("Can't resume past the received bytes")
+)
+
+// ActiveFileDownload tracks a file whose parts are being received. Its state is
+// saved next to the temp file, so an interrupted download can be resumed even
+// after a restart.
+type ActiveFileDownload struct {
+	FileName      string        `json:"file_name"`
+	FilePath      string        `json:"file_path"`
+	FileSize      int64         `json:"file_size"`
+	FileMode      uint32        `json:"file_mode"`
+	Sparse        bool          `json:"sparse"`
+	ModTime       time.Time     `json:"mod_time"`
+	TempName      string        `json:"temp_name"`
+	PartRanges    []FileRange   `json:"part_ranges"`
+	PartsWritten  []int64       `json:"parts_written"`
+	PartHashes    []string      `json:"part_hashes"`
+	FileHash      string        `json:"file_hash"`
+	HashAlgorithm HashAlgorithm `json:"hash_algorithm"`
+	FileParts     int           `json:"file_parts"`
+	PartsFinished int           `json:"parts_finished"`
+	PartsFailed   int           `json:"parts_failed"`
+	Done          bool          `json:"done"`
+
+	file         *os.File
+	active_parts []bool
+	mu           sync.Mutex
+}
+
+//go:generate easytags $GOFILE
+type ResumeStateJSON struct {
+	PartsWritten []int64 `json:"parts_written"`
+	PartsDone    []bool  `json:"parts_done"`
+}
+
+func (rs ResumeStateJSON) written(part_num int) int64 {
+	if part_num >= len(rs.PartsWritten) {
+		return 0
+	}
+	return rs.PartsWritten[part_num]
+}
+
+func (rs ResumeStateJSON) done(part_num int) bool {
+	return part_num < len(rs.PartsDone) && rs.PartsDone[part_num]
+}
+
+func NewActiveFileDownload(temp_name string, file_info FileInfoJSON) *ActiveFileDownload {
+	afd := &ActiveFileDownload{TempName: temp_name, FileName: file_info.Name, FileSize: file_info.Size, FileParts: file_info.Parts, Done: false}
+	afd.FilePath = file_info.relPath()
+	afd.FileMode = file_info.Mode
+	afd.ModTime = file_info.ModTime
+	afd.Sparse = file_info.Sparse
+	afd.HashAlgorithm = file_info.HashAlgorithm
+	afd.FileHash = file_info.FileHash
+	afd.PartRanges = make([]FileRange, afd.FileParts)
+	afd.PartsWritten = make([]int64, afd.FileParts)
+	afd.PartHashes = make([]string, afd.FileParts)
+	afd.active_parts = make([]bool, afd.FileParts)
+
+	return afd
+}
+
+func downloadTempName(downloads_dir string, file_name string, uuid UUID) string {
+	return path.Join(downloads_dir, "."+file_name+"_"+uuid.String())
+}
+
+func downloadStateName(temp_name string) string {
+	return temp_name + ".json"
+}
+
+// loadActiveFileDownload reads the state saved for `temp_name`, it returns nil
+// if there is none.
+func loadActiveFileDownload(temp_name string) (*ActiveFileDownload, error) {
+	data, err := os.ReadFile(downloadStateName(temp_name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("On read download state: %w", err)
+	}
+
+	afd := &ActiveFileDownload{}
+	err = json.Unmarshal(data, afd)
+	if err != nil {
+		return nil, fmt.Errorf("On unmarshal download state: %w", err)
+	}
+	if afd.FileParts < 1 || len(afd.PartRanges) != afd.FileParts ||
+		len(afd.PartsWritten) != afd.FileParts || len(afd.PartHashes) != afd.FileParts {
+		return nil, fmt.Errorf("%w: corrupt download state `%s`", ErrPartsMismatch, downloadStateName(temp_name))
+	}
+
+	afd.TempName = temp_name
+	if afd.FilePath == "" {
+		afd.FilePath = afd.FileName
+	}
+	afd.PartsFailed = 0
+	afd.active_parts = make([]bool, afd.FileParts)
+	return afd, nil
+}
+
+// saveState atomically replaces the saved state, the caller must hold `mu`.
+func (afd *ActiveFileDownload) saveState() error {
+	data, err := json.Marshal(afd)
+	if err != nil {
+		return fmt.Errorf("On marshal download state: %w", err)
+	}
+
+	state_name := downloadStateName(afd.TempName)
+	err = os.WriteFile(state_name+".tmp", data, 0666)
+	if err != nil {
+		return fmt.Errorf("On write download state: %w", err)
+	}
+	err = os.Rename(state_name+".tmp", state_name)
+	if err != nil {
+		return fmt.Errorf("On rename download state: %w", err)
+	}
+	return nil
+}
+
+func (afd *ActiveFileDownload) matches(file_info FileInfoJSON) error {
+	if afd.FileParts != file_info.Parts || afd.FileSize != file_info.Size ||
+		afd.HashAlgorithm != file_info.HashAlgorithm {
+		return fmt.Errorf("%w: expected %d parts of %d bytes (%s), got %d parts of %d bytes (%s)",
+			ErrPartsMismatch, afd.FileParts, afd.FileSize, afd.HashAlgorithm,
+			file_info.Parts, file_info.Size, file_info.HashAlgorithm)
+	}
+	if !hashesEqual(afd.FileHash, file_info.FileHash) {
+		return fmt.Errorf("%w: expected %s, got %s", ErrFileHashMismatch, afd.FileHash, file_info.FileHash)
+	}
+	return nil
+}
+
+func (afd *ActiveFileDownload) resumeState() ResumeStateJSON {
+	afd.mu.Lock()
+	defer afd.mu.Unlock()
+
+	state := ResumeStateJSON{PartsWritten: make([]int64, afd.FileParts), PartsDone: make([]bool, afd.FileParts)}
+	copy(state.PartsWritten, afd.PartsWritten)
+	for i, part_hash := range afd.PartHashes {
+		state.PartsDone[i] = part_hash != ""
+	}
+	return state
+}
+
+// startPart marks a part as being received from `resume` bytes in and returns
+// the temp file, creating it at its full size on first use so every part can
+// write its own range in place.
+func (afd *ActiveFileDownload) startPart(part_num int, resume int64) (*os.File, error) {
+	afd.mu.Lock()
+	defer afd.mu.Unlock()
+
+	if afd.PartHashes[part_num] != "" {
+		return nil, fmt.Errorf("%w: %d", ErrPartAlreadyFinished, part_num)
+	}
+	if afd.active_parts[part_num] {
+		return nil, fmt.Errorf("%w: %d", ErrPartAlreadyActive, part_num)
+	}
+	if resume > afd.PartsWritten[part_num] {
+		return nil, fmt.Errorf("%w: part %d at %d, have %d", ErrInvalidResume, part_num, resume, afd.PartsWritten[part_num])
+	}
+
+	if afd.file == nil {
+		file, err := os.OpenFile(afd.TempName, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, fmt.Errorf("On file create: %w", err)
+		}
+
+		// Reserving the space of a sparse file would fill in its holes
+		if afd.Sparse {
+			err = preallocateTruncate(file, afd.FileSize)
+		} else {
+			err = preallocate(file, afd.FileSize)
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		afd.file = file
+	}
+
+	afd.PartsWritten[part_num] = resume
+	err := afd.saveState()
+	if err != nil {
+		return nil, err
+	}
+
+	afd.active_parts[part_num] = true
+	return afd.file, nil
+}
+
+// checkpoint records that the first `written` bytes of a part are on disk.
+func (afd *ActiveFileDownload) checkpoint(part_num int, written int64) error {
+	afd.mu.Lock()
+	defer afd.mu.Unlock()
+
+	afd.PartsWritten[part_num] = written
+	return afd.saveState()
+}
+
+// finishPart records the outcome of a single part and reports whether every
+// part of the file has now been received. A failed part keeps its bytes on disk,
+// they are verified chunk by chunk when it's resumed.
+func (afd *ActiveFileDownload) finishPart(part_num int, part_range FileRange, part_hash string, part_err error) bool {
+	afd.mu.Lock()
+	defer afd.mu.Unlock()
+
+	afd.active_parts[part_num] = false
+
+	if part_err != nil {
+		afd.PartsFailed++
+	} else {
+		afd.PartRanges[part_num] = part_range
+		afd.PartHashes[part_num] = part_hash
+		afd.PartsFinished++
+	}
+
+	err := afd.saveState()
+	if err != nil {
+		log.Warn("Couldn't save download state of `%s`: %s", afd.FileName, err)
+	}
+
+	if afd.PartsFinished < afd.FileParts {
+		afd.closeIfIdle()
+		return false
+	}
+
+	afd.Done = true
+	return true
+}
+
+// closeIfIdle releases the temp file while no part is being received, the
+// caller must hold `mu`.
+func (afd *ActiveFileDownload) closeIfIdle() {
+	for _, active := range afd.active_parts {
+		if active {
+			return
+		}
+	}
+	if afd.file != nil {
+		afd.file.Close()
+		afd.file = nil
+	}
+}
+
+func (afd *ActiveFileDownload) finalize(downloads_dir string, preserve_metadata bool) (string, error) {
+	if afd.file != nil {
+		err := afd.file.Close()
+		afd.file = nil
+		if err != nil {
+			return "", fmt.Errorf("On close: %w", err)
+		}
+	}
+
+	err := validateRanges(afd.PartRanges, afd.FileSize)
+	if err != nil {
+		return "", err
+	}
+
+	file_hash, err := fileDigest(afd.HashAlgorithm, afd.PartHashes)
+	if err != nil {
+		return "", err
+	}
+	if !hashesEqual(file_hash, afd.FileHash) {
+		return "", fmt.Errorf("%w: expected %s, got %s", ErrFileHashMismatch, afd.FileHash, file_hash)
+	}
+
+	// Reserve a free name, then atomically replace it with the download
+	dir_name, err := confinedDir(downloads_dir, path.Dir(afd.FilePath))
+	if err != nil {
+		return "", err
+	}
+	file, file_name, err := tryCreateNewFile(path.Join(dir_name, path.Base(afd.FilePath)))
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+
+	err = os.Rename(afd.TempName, file_name)
+	if err != nil {
+		os.Remove(file_name)
+		return "", fmt.Errorf("On rename: %w", err)
+	}
+
+	err = os.Remove(downloadStateName(afd.TempName))
+	if err != nil {
+		log.Warn("Couldn't remove download state: %s", err)
+	}
+
+	if preserve_metadata {
+		err = applyMetadata(file_name, afd.FileMode, afd.ModTime)
+		if err != nil {
+			log.Warn("Couldn't apply metadata to `%s`: %s", file_name, err)
+		}
+	}
+
+	return file_name, nil
+}
+
+// remove deletes the temp file and the saved state of the download.
+func (afd *ActiveFileDownload) remove() {
+	if afd.file != nil {
+		afd.file.Close()
+		afd.file = nil
+	}
+	for _, name := range []string{afd.TempName, downloadStateName(afd.TempName)} {
+		err := os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warn("Couldn't remove `%s`: %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// ErrorCode is the kind of an error sent to the peer. The values are part of
+// the protocol, new codes go at the end.
+type ErrorCode uint16
+
+const (
+	CodeOK                 ErrorCode = 0
+	CodeUnsupportedRequest ErrorCode = 1
+	CodeInvalidMetadata    ErrorCode = 2
+	CodeQuotaExceeded      ErrorCode = 3
+	CodeAuthFailed         ErrorCode = 4
+	CodeChecksumMismatch   ErrorCode = 5
+	CodeCancelled          ErrorCode = 6
+	CodeInternal           ErrorCode = 7
+	CodeRejected           ErrorCode = 8
+)
+
+var (
+	ErrUnsupportedRequest = errors.New("Unsupported request")
+	ErrInvalidMetadata    = errors.New("Invalid metadata")
+	ErrQuotaExceeded      = errors.New("Quota exceeded")
+	ErrChecksumMismatch   = errors.New("Checksum mismatch")
+	ErrCancelled          = errors.New("Cancelled")
+	ErrInternal           = errors.New("Internal error")
+	ErrRejected           = errors.New("Rejected")
+)
+
+type errorCodeInfo struct {
+	code ErrorCode
+	name string
+	// sentinel is what an error with the code from the peer matches
+	sentinel error
+	// local are the errors that are sent with the code
+	local []error
+}
+
+var error_codes = []errorCodeInfo{
+	{CodeUnsupportedRequest, "unsupported_request", ErrUnsupportedRequest, []error{ErrUnsupportedRequest,
+		ErrUnrecognizedRequestType, ErrUnsupportedCompression, ErrUnknownCompression, ErrUnknownHashAlgorithm,
+		ErrIncompatiblePeer}},
+	{CodeInvalidMetadata, "invalid_metadata", ErrInvalidMetadata, []error{ErrInvalidMetadata,
+		ErrInvalidFrame, ErrInvalidFilePath, ErrInvalidSize, ErrInvalidFileRange, ErrInvalidFileRanges,
+		ErrInvalidPartNumber, ErrInvalidNumberOfParts, ErrInvalidResume, ErrPartsMismatch,
+		ErrPartAlreadyFinished, ErrPartAlreadyActive, ErrUnknownFileDownload, ErrSymlinkEscapesRoot,
+		ErrPathThroughSymlink}},
+	{CodeQuotaExceeded, "quota_exceeded", ErrQuotaExceeded, []error{ErrQuotaExceeded,
+		syscall.ENOSPC, syscall.EDQUOT}},
+	{CodeAuthFailed, "auth_failed", ErrAuthenticationFailed, []error{ErrAuthenticationFailed,
+		ErrAuthRateLimited, ErrPeerFingerprintMismatch, ErrNoPeerCertificate, ErrPakeConfirmation, ErrHelloTampered}},
+	{CodeChecksumMismatch, "checksum_mismatch", ErrChecksumMismatch, []error{ErrChecksumMismatch,
+		ErrFileHashMismatch, ErrPartHashMismatch, ErrChunkHashMismatch}},
+	{CodeCancelled, "cancelled", ErrCancelled, []error{ErrCancelled,
+		context.Canceled}},
+	{CodeInternal, "internal", ErrInternal, []error{ErrInternal}},
+	{CodeRejected, "rejected", ErrRejected, []error{ErrRejected,
+		ErrNotOffered, ErrOfferDeclined}},
+}
+
+func (ec ErrorCode) info() (errorCodeInfo, bool) {
+	for _, info := range error_codes {
+		if info.code == ec {
+			return info, true
+		}
+	}
+	return errorCodeInfo{}, false
+}
+
+func (ec ErrorCode) String() string {
+	if ec == CodeOK {
+		return "ok"
+	}
+	info, ok := ec.info()
+	if !ok {
+		return fmt.Sprintf("code %d", uint16(ec))
+	}
+	return info.name
+}
+
+// codeOf is the code `err` is sent to the peer with.
+func codeOf(err error) ErrorCode {
+	if err == nil {
+		return CodeOK
+	}
+	for _, info := range error_codes {
+		for _, local := range info.local {
+			if errors.Is(err, local) {
+				return info.code
+			}
+		}
+	}
+	return CodeInternal
+}
+
+// RemoteError is an error the peer sent. It matches the sentinel of its code
+// with errors.Is, e.g. ErrChecksumMismatch.
+type RemoteError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (re *RemoteError) Error() string {
+	return fmt.Sprintf("Peer reported %s: %s", re.Code, re.Message)
+}
+
+func (re *RemoteError) Unwrap() error {
+	info, ok := re.Code.info()
+	if !ok {
+		// A code from a newer peer
+		return ErrInternal
+	}
+	return info.sentinel
+}
+
+// remoteError is the error the peer sent as `code` and `message`, nil for CodeOK.
+func remoteError(code ErrorCode, message string) error {
+	if code == CodeOK {
+		return nil
+	}
+	return &RemoteError{Code: code, Message: message}
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// TestErrorCodeRoundTrip sends every local error of every code as a status,
+// in binary and JSON, and checks it matches the sentinel of its code.
+func TestErrorCodeRoundTrip(t *testing.T) {
+	for _, info := range error_codes {
+		for _, local := range info.local {
+			err := fmt.Errorf("On test: %w", local)
+			status := statusOf(err)
+			if status.Code != info.code {
+				t.Fatalf("`%s` is sent as %s, want %s", local, status.Code, info.code)
+			}
+
+			e := &frameEncoder{}
+			status.encodeBinary(e)
+			var binary_status StatusJSON
+			d := &frameDecoder{buf: e.buf}
+			binary_status.decodeBinary(d)
+			if d.err != nil {
+				t.Fatal(d.err)
+			}
+
+			payload, err := json.Marshal(status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var json_status StatusJSON
+			err = json.Unmarshal(payload, &json_status)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, received := range []StatusJSON{binary_status, json_status} {
+				if received != status {
+					t.Fatalf("Got %#v, want %#v", received, status)
+				}
+				if !errors.Is(received.err(), info.sentinel) {
+					t.Fatalf("`%s` came back as %v, want %v", local, received.err(), info.sentinel)
+				}
+			}
+		}
+	}
+
+	if statusOf(nil).err() != nil {
+		t.Fatal("No error came back as an error")
+	}
+	// A code from a newer peer
+	if !errors.Is(StatusJSON{Code: 1000}.err(), ErrInternal) {
+		t.Fatalf("An unknown code isn't %v", ErrInternal)
+	}
+}
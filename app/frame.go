@@ -0,0 +1,481 @@
+package app
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var ErrInvalidFrame = errors.New("Invalid frame")
+
+// Every message is sent in a frame:
+//
+//	type (1 byte) | flags (1 byte) | length (4 bytes, big endian) | payload
+//
+// Request headers, file metadata and statuses have a binary payload, everything
+// else is JSON. FrameFlagJSON marks a payload that is JSON anyway, for debugging.
+type FrameType uint8
+
+const (
+	FrameMessage FrameType = iota
+	FrameRequestHeader
+	FrameFileInfo
+	FrameOffer
+	FrameStatus
+)
+
+type FrameFlags uint8
+
+const (
+	FrameFlagJSON FrameFlags = 1 << iota
+)
+
+const (
+	FRAME_HEADER_SIZE = 6
+	MAX_FRAME_SIZE    = 256 * MiB
+	// The fewest bytes a FileInfoJSON encodes to, every field empty
+	MIN_FILE_INFO_SIZE = 21
+)
+
+// binaryEncoder and binaryDecoder are messages with a hand-written binary encoding.
+type binaryEncoder interface {
+	encodeBinary(e *frameEncoder)
+}
+
+type binaryDecoder interface {
+	decodeBinary(d *frameDecoder)
+}
+
+func frameTypeOf(message any) FrameType {
+	switch message.(type) {
+	case RequestHeader, *RequestHeader:
+		return FrameRequestHeader
+	case FileInfoJSON, *FileInfoJSON:
+		return FrameFileInfo
+	case OfferJSON, *OfferJSON:
+		return FrameOffer
+	case StatusJSON, *StatusJSON:
+		return FrameStatus
+	default:
+		return FrameMessage
+	}
+}
+
+// sendMessage sends `message` in a frame, in binary if it has a binary
+// encoding and the connection isn't sending JSON frames.
+func (conn *Conn) sendMessage(message any) (int64, error) {
+	var flags FrameFlags
+	var payload []byte
+
+	binary_message, ok := message.(binaryEncoder)
+	if ok && !conn.json_frames {
+		e := &frameEncoder{}
+		binary_message.encodeBinary(e)
+		if e.err != nil {
+			return 0, fmt.Errorf("On encode: %w", e.err)
+		}
+		payload = e.buf
+	} else {
+		var err error
+		payload, err = json.Marshal(message)
+		if err != nil {
+			return 0, fmt.Errorf("On marshal: %w", err)
+		}
+		flags |= FrameFlagJSON
+	}
+
+	err := conn.writeFrame(frameTypeOf(message), flags, payload)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(payload)), nil
+}
+
+// receiveMessage reads the next frame, which has to hold a `T`. A status in
+// its place is returned as the error it reports.
+func receiveMessage[T any](conn *Conn) (T, error) {
+	var rv T
+	frame_type, flags, payload, err := conn.readFrame()
+	if err != nil {
+		return rv, err
+	}
+	if frame_type == FrameStatus && frameTypeOf(rv) != FrameStatus {
+		status, err := decodeFrame[StatusJSON](frame_type, flags, payload)
+		if err != nil {
+			return rv, err
+		}
+		err = status.err()
+		if err == nil {
+			err = fmt.Errorf("%w: status before the reply", ErrInvalidFrame)
+		}
+		return rv, err
+	}
+	return decodeFrame[T](frame_type, flags, payload)
+}
+
+func decodeFrame[T any](frame_type FrameType, flags FrameFlags, payload []byte) (T, error) {
+	var rv T
+	if frame_type != frameTypeOf(rv) {
+		return rv, fmt.Errorf("%w: expected type %d, got %d", ErrInvalidFrame, frameTypeOf(rv), frame_type)
+	}
+
+	if flags&FrameFlagJSON != 0 {
+		err := json.Unmarshal(payload, &rv)
+		if err != nil {
+			return rv, fmt.Errorf("On unmarshal: %w", err)
+		}
+		return rv, nil
+	}
+
+	binary_message, ok := any(&rv).(binaryDecoder)
+	if !ok {
+		return rv, fmt.Errorf("%w: type %d has no binary encoding", ErrInvalidFrame, frame_type)
+	}
+	d := &frameDecoder{buf: payload}
+	binary_message.decodeBinary(d)
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = fmt.Errorf("%d bytes left over", len(d.buf))
+	}
+	if d.err != nil {
+		return rv, fmt.Errorf("%w: type %d: %w", ErrInvalidFrame, frame_type, d.err)
+	}
+	return rv, nil
+}
+
+func (conn *Conn) writeFrame(frame_type FrameType, flags FrameFlags, payload []byte) error {
+	if int64(len(payload)) > MAX_FRAME_SIZE {
+		return fmt.Errorf("%w: %d bytes", ErrInvalidFrame, len(payload))
+	}
+
+	frame := make([]byte, FRAME_HEADER_SIZE, FRAME_HEADER_SIZE+len(payload))
+	frame[0] = byte(frame_type)
+	frame[1] = byte(flags)
+	binary.BigEndian.PutUint32(frame[2:], uint32(len(payload)))
+	frame = append(frame, payload...)
+
+	_, err := conn.Write(frame)
+	if err != nil {
+		return fmt.Errorf("On write frame: %w", err)
+	}
+	return nil
+}
+
+func (conn *Conn) readFrame() (FrameType, FrameFlags, []byte, error) {
+	header := make([]byte, FRAME_HEADER_SIZE)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("On read frame header: %w", err)
+	}
+
+	size := binary.BigEndian.Uint32(header[2:])
+	if int64(size) > MAX_FRAME_SIZE {
+		return 0, 0, nil, fmt.Errorf("%w: %d bytes", ErrInvalidFrame, size)
+	}
+
+	// Grown as it arrives, a peer can't make us allocate a frame it never sends
+	payload := make([]byte, 0, min(size, uint32(TEMP_B_SIZE)))
+	for int64(len(payload)) < int64(size) {
+		n := min(int(size)-len(payload), int(TEMP_B_SIZE))
+		payload = append(payload, make([]byte, n)...)
+		_, err = io.ReadFull(conn, payload[len(payload)-n:])
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("On read frame: %w", err)
+		}
+	}
+	return FrameType(header[0]), FrameFlags(header[1]), payload, nil
+}
+
+// frameEncoder appends the fields of a binary message, the first error sticks.
+type frameEncoder struct {
+	buf []byte
+	err error
+}
+
+func (e *frameEncoder) uint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *frameEncoder) int(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *frameEncoder) bool(v bool) {
+	if v {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *frameEncoder) bytes(v []byte) {
+	e.uint(uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *frameEncoder) string(v string) {
+	e.uint(uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// hash sends a hex hash as its raw bytes.
+func (e *frameEncoder) hash(v string) {
+	raw, err := hex.DecodeString(v)
+	if err != nil && e.err == nil {
+		e.err = fmt.Errorf("On hash `%s`: %w", v, err)
+	}
+	e.bytes(raw)
+}
+
+func (e *frameEncoder) hashes(v []string) {
+	e.uint(uint64(len(v)))
+	for _, h := range v {
+		e.hash(h)
+	}
+}
+
+func (e *frameEncoder) ints(v []int) {
+	e.uint(uint64(len(v)))
+	for _, i := range v {
+		e.int(int64(i))
+	}
+}
+
+func (e *frameEncoder) time(v time.Time) {
+	e.bool(!v.IsZero())
+	if !v.IsZero() {
+		e.int(v.Unix())
+		e.uint(uint64(v.Nanosecond()))
+	}
+}
+
+func (e *frameEncoder) uuid(v UUID) {
+	e.buf = append(e.buf, v[:]...)
+}
+
+// frameDecoder reads the fields of a binary message, after the first error
+// everything reads as zero.
+type frameDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *frameDecoder) fail(format string, args ...any) {
+	if d.err == nil {
+		d.err = fmt.Errorf(format, args...)
+	}
+	d.buf = nil
+}
+
+func (d *frameDecoder) uint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail("bad uvarint")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *frameDecoder) int() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail("bad varint")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// count reads the length of a list whose elements take at least `min_size`
+// bytes each, so a peer can't claim more than the frame holds.
+func (d *frameDecoder) count(min_size int) int {
+	n := d.uint()
+	if n > uint64(len(d.buf)/min_size) {
+		d.fail("%d elements of at least %d bytes in %d bytes", n, min_size, len(d.buf))
+		return 0
+	}
+	return int(n)
+}
+
+func (d *frameDecoder) bool() bool {
+	if len(d.buf) < 1 {
+		d.fail("short bool")
+		return false
+	}
+	v := d.buf[0]
+	d.buf = d.buf[1:]
+	if v > 1 {
+		d.fail("bad bool %d", v)
+	}
+	return v == 1
+}
+
+func (d *frameDecoder) bytes() []byte {
+	n := d.count(1)
+	v := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *frameDecoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *frameDecoder) hash() string {
+	return hex.EncodeToString(d.bytes())
+}
+
+func (d *frameDecoder) hashes() []string {
+	n := d.count(1)
+	if n == 0 {
+		return nil
+	}
+	v := make([]string, n)
+	for i := range v {
+		v[i] = d.hash()
+	}
+	return v
+}
+
+func (d *frameDecoder) ints() []int {
+	n := d.count(1)
+	if n == 0 {
+		return nil
+	}
+	v := make([]int, n)
+	for i := range v {
+		v[i] = int(d.int())
+	}
+	return v
+}
+
+func (d *frameDecoder) time() time.Time {
+	if !d.bool() {
+		return time.Time{}
+	}
+	sec := d.int()
+	nsec := d.uint()
+	if nsec >= uint64(time.Second) {
+		d.fail("bad nanoseconds %d", nsec)
+		return time.Time{}
+	}
+	return time.Unix(sec, int64(nsec))
+}
+
+func (d *frameDecoder) uuid() UUID {
+	var v UUID
+	if len(d.buf) < len(v) {
+		d.fail("short uuid")
+		return v
+	}
+	copy(v[:], d.buf)
+	d.buf = d.buf[len(v):]
+	return v
+}
+
+func (rh RequestHeader) encodeBinary(e *frameEncoder) {
+	e.uint(uint64(rh.RequestType))
+	e.uuid(rh.UUID)
+	e.uuid(rh.Session)
+}
+
+func (rh *RequestHeader) decodeBinary(d *frameDecoder) {
+	rh.RequestType = RequestType(d.uint())
+	rh.UUID = d.uuid()
+	rh.Session = d.uuid()
+}
+
+func (fi FileInfoJSON) encodeBinary(e *frameEncoder) {
+	e.string(fi.Name)
+	e.string(fi.Path)
+	e.int(fi.Size)
+	e.uint(uint64(fi.Mode))
+	e.time(fi.ModTime)
+	e.bool(fi.IsDir)
+	e.string(fi.LinkTarget)
+
+	e.string(fi.PartName)
+	e.int(int64(fi.PartNumber))
+	e.int(int64(fi.Parts))
+	e.int(fi.Offset)
+	e.int(fi.Length)
+	e.int(fi.Resume)
+
+	e.bool(fi.Sparse)
+	e.ints(fi.HoleChunks)
+	e.string(string(fi.Compression))
+
+	e.string(string(fi.HashAlgorithm))
+	e.int(fi.ChunkSize)
+	e.hash(fi.FileHash)
+	e.hashes(fi.PartHashes)
+	e.hashes(fi.ChunkHashes)
+}
+
+func (fi *FileInfoJSON) decodeBinary(d *frameDecoder) {
+	fi.Name = d.string()
+	fi.Path = d.string()
+	fi.Size = d.int()
+	fi.Mode = uint32(d.uint())
+	fi.ModTime = d.time()
+	fi.IsDir = d.bool()
+	fi.LinkTarget = d.string()
+
+	fi.PartName = d.string()
+	fi.PartNumber = int(d.int())
+	fi.Parts = int(d.int())
+	fi.Offset = d.int()
+	fi.Length = d.int()
+	fi.Resume = d.int()
+
+	fi.Sparse = d.bool()
+	fi.HoleChunks = d.ints()
+	fi.Compression = Compression(d.string())
+
+	fi.HashAlgorithm = HashAlgorithm(d.string())
+	fi.ChunkSize = d.int()
+	fi.FileHash = d.hash()
+	fi.PartHashes = d.hashes()
+	fi.ChunkHashes = d.hashes()
+}
+
+func (o OfferJSON) encodeBinary(e *frameEncoder) {
+	e.string(o.Name)
+	e.uint(uint64(len(o.Files)))
+	for _, file_info := range o.Files {
+		file_info.encodeBinary(e)
+	}
+}
+
+func (o *OfferJSON) decodeBinary(d *frameDecoder) {
+	o.Name = d.string()
+	n := d.count(MIN_FILE_INFO_SIZE)
+	if n > MAX_OFFER_FILES {
+		d.fail("%d files in an offer", n)
+		return
+	}
+	// Grown as they decode, a bad entry stops it before it all is allocated
+	o.Files = nil
+	for range n {
+		var file_info FileInfoJSON
+		file_info.decodeBinary(d)
+		if d.err != nil {
+			return
+		}
+		o.Files = append(o.Files, file_info)
+	}
+}
+
+func (s StatusJSON) encodeBinary(e *frameEncoder) {
+	e.uint(uint64(s.Code))
+	e.string(s.Message)
+}
+
+func (s *StatusJSON) decodeBinary(d *frameDecoder) {
+	s.Code = ErrorCode(d.uint())
+	s.Message = d.string()
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDecodeOfferBound(t *testing.T) {
+	e := &frameEncoder{}
+	OfferJSON{Name: "test", Files: []FileInfoJSON{{Name: "a.bin", Size: 5}, {}}}.encodeBinary(e)
+	var offer OfferJSON
+	d := &frameDecoder{buf: e.buf}
+	offer.decodeBinary(d)
+	if d.err != nil || len(offer.Files) != 2 || offer.Files[0].Name != "a.bin" {
+		t.Fatalf("Decoded %#v: %v", offer, d.err)
+	}
+
+	// Claims 2^28-1 files in a hundred bytes
+	e = &frameEncoder{}
+	e.string("test")
+	e.uint(1<<28 - 1)
+	d = &frameDecoder{buf: append(e.buf, make([]byte, 100)...)}
+	offer = OfferJSON{}
+	offer.decodeBinary(d)
+	if d.err == nil || len(offer.Files) != 0 {
+		t.Fatalf("Decoded %d files without an error", len(offer.Files))
+	}
+}
+
+// bufferConn is a connection that reads back what was written to it.
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (bc *bufferConn) Close() error {
+	return nil
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	request_header := RequestHeader{RequestType: RequestSendFile, UUID: uuid.New(), Session: uuid.New()}
+	file_info := FileInfoJSON{
+		Name: "a.bin", Path: "sub/a.bin", Size: 1 << 40, Mode: 0o640, ModTime: time.Unix(1700000000, 123456789),
+		PartName: "a.bin.part2", PartNumber: 2, Parts: 3, Offset: 100, Length: 200, Resume: 50,
+		Sparse: true, HoleChunks: []int{0, 3}, Compression: CompressionZstd,
+		HashAlgorithm: HashXXH64, ChunkSize: 1 << 20, FileHash: "0123456789abcdef",
+		PartHashes: []string{"0123456789abcdef"}, ChunkHashes: []string{"fedcba9876543210", "0011223344556677"},
+	}
+
+	tests := []struct {
+		name        string
+		json_frames bool
+		flags       FrameFlags
+	}{
+		{"binary", false, 0},
+		{"json", true, FrameFlagJSON},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bufferConn{}
+			conn := NewConn(buf)
+			conn.json_frames = test.json_frames
+
+			_, err := conn.sendMessage(request_header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if FrameFlags(buf.Bytes()[1]) != test.flags {
+				t.Fatalf("The flags byte is %#x, want %#x", buf.Bytes()[1], test.flags)
+			}
+			got_header, err := receiveMessage[RequestHeader](conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got_header != request_header {
+				t.Fatalf("Got %s, want %s", got_header, request_header)
+			}
+
+			_, err = conn.sendMessage(file_info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if FrameFlags(buf.Bytes()[1]) != test.flags {
+				t.Fatalf("The flags byte is %#x, want %#x", buf.Bytes()[1], test.flags)
+			}
+			got_info, err := receiveMessage[FileInfoJSON](conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got_info.ModTime.Equal(file_info.ModTime) {
+				t.Fatalf("Got mod time %s, want %s", got_info.ModTime, file_info.ModTime)
+			}
+			got_info.ModTime = file_info.ModTime
+			if !reflect.DeepEqual(got_info, file_info) {
+				t.Fatalf("Got %#v, want %#v", got_info, file_info)
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("%d bytes left over", buf.Len())
+			}
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package app
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"os"
+	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,7 +24,23 @@ const (
 
 	TEMP_B_SIZE = 256 * KiB
 
-	NUMBER_OF_PARTS = 4
+	// A file gets one part per MIN_PART_SIZE bytes, capped at MAX_NUMBER_OF_PARTS
+	MIN_PART_SIZE       = 64 * MiB
+	MAX_NUMBER_OF_PARTS = 64
+
+	// How often a receiver makes the bytes of a part durable for resuming
+	RESUME_CHECKPOINT_SIZE = 64 * MiB
+
+	// Parts are verified, resumed and retransmitted in chunks of CHUNK_SIZE
+	CHUNK_SIZE       = 1 * MiB
+	MAX_CHUNK_SIZE   = 64 * MiB
+	MAX_CHUNK_ROUNDS = 3
+)
+
+var (
+	ErrInvalidFileRanges = errors.New("Part ranges don't cover the file")
+	ErrInvalidFilePath   = errors.New("Invalid file path")
+	ErrInvalidSize       = errors.New("Invalid size")
 )
 
 var (
@@ -34,40 +54,198 @@ type RequestType int
 const (
 	RequestSendString RequestType = iota
 	RequestSendFile
+	RequestResumeQuery
+	RequestMakeDir
+	RequestMakeSymlink
+	RequestOffer
+	RequestEndSession
 )
 
 //go:generate easytags $GOFILE
 type RequestHeader struct {
 	RequestType RequestType `json:"request_type"`
 	UUID        UUID        `json:"uuid"`
+	// Session is the session the request is part of, its offer was accepted
+	Session UUID `json:"session"`
 }
 
 func (rh RequestHeader) String() string {
-	return fmt.Sprintf("{UUID:%s, RequestType:%d}", rh.UUID, rh.RequestType)
+	return fmt.Sprintf("{UUID:%s, RequestType:%d, Session:%s}", rh.UUID, rh.RequestType, rh.Session)
 }
 
 type FileInfoJSON struct {
-	Name    string    `json:"name"`
-	Size    int64     `json:"size"`
-	Mode    string    `json:"mode"`
-	ModTime time.Time `json:"mod_time"`
-	IsDir   bool      `json:"is_dir"`
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	Mode       uint32    `json:"mode"`
+	ModTime    time.Time `json:"mod_time"`
+	IsDir      bool      `json:"is_dir"`
+	LinkTarget string    `json:"link_target"`
+
+	PartName   string `json:"part_name"`
+	PartNumber int    `json:"part_number"`
+	Parts      int    `json:"parts"`
+	Offset     int64  `json:"offset"`
+	Length     int64  `json:"length"`
+	Resume     int64  `json:"resume"`
+
+	// Sparse files keep their holes on the receiver, the hole chunks of a part
+	// aren't sent
+	Sparse     bool  `json:"sparse"`
+	HoleChunks []int `json:"hole_chunks"`
+
+	// Compression of the part body, the receiver said it supports it
+	Compression Compression `json:"compression"`
+
+	HashAlgorithm HashAlgorithm `json:"hash_algorithm"`
+	ChunkSize     int64         `json:"chunk_size"`
+	FileHash      string        `json:"file_hash"`
+	PartHashes    []string      `json:"part_hashes"`
+	ChunkHashes   []string      `json:"chunk_hashes"`
+}
+
+// FileRange is the byte range `[Offset, Offset+Length)` of a file covered by a part.
+type FileRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+func (fr FileRange) String() string {
+	return fmt.Sprintf("{Offset:%d, Length:%d}", fr.Offset, fr.Length)
+}
+
+func (fr FileRange) End() int64 {
+	return fr.Offset + fr.Length
+}
+
+// SplitIntoRanges splits `size` bytes into `parts` contiguous ranges. The last
+// range also covers the `size % parts` remainder.
+func SplitIntoRanges(size int64, parts int) []FileRange {
+	ranges := make([]FileRange, parts)
+	part_size := size / int64(parts)
+	for i := range ranges {
+		ranges[i] = FileRange{Offset: part_size * int64(i), Length: part_size}
+	}
+	ranges[parts-1].Length = size - ranges[parts-1].Offset
+
+	return ranges
+}
+
+// validateRanges checks that `ranges`, in order, tile `[0, size)` exactly.
+func validateRanges(ranges []FileRange, size int64) error {
+	var next int64
+	for i, r := range ranges {
+		if r.Offset != next || r.Length < 0 {
+			return fmt.Errorf("%w: part %d is %s, expected offset %d", ErrInvalidFileRanges, i, r, next)
+		}
+		next = r.End()
+	}
+	if next != size {
+		return fmt.Errorf("%w: parts cover %d of %d bytes", ErrInvalidFileRanges, next, size)
+	}
+	return nil
+}
+
+// validateFilePath checks that a file from a peer stays inside the downloads dir.
+func validateFilePath(file_info FileInfoJSON) error {
+	if file_info.Name == "" || file_info.Name == "." || file_info.Name == ".." ||
+		strings.ContainsAny(file_info.Name, `/\`) {
+		return fmt.Errorf("%w: name `%s`", ErrInvalidFilePath, file_info.Name)
+	}
+	if file_info.Path != "" && !filepath.IsLocal(filepath.FromSlash(file_info.Path)) {
+		return fmt.Errorf("%w: path `%s`", ErrInvalidFilePath, file_info.Path)
+	}
+	return nil
+}
+
+// relPath is where the file goes under the downloads dir.
+func (fi FileInfoJSON) relPath() string {
+	if fi.Path == "" {
+		return fi.Name
+	}
+	return fi.Path
+}
+
+// UnixMode returns the permission, setuid, setgid and sticky bits of `mode` as
+// they are laid out in a Unix mode, e.g. 0755.
+func UnixMode(mode os.FileMode) uint32 {
+	unix_mode := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		unix_mode |= 0o4000
+	}
+	if mode&os.ModeSetgid != 0 {
+		unix_mode |= 0o2000
+	}
+	if mode&os.ModeSticky != 0 {
+		unix_mode |= 0o1000
+	}
+	return unix_mode
+}
 
-	PartName string `json:"part_name"`
+// applyMetadata gives a received file the sender's permissions and mod time.
+// The setuid, setgid and sticky bits of a peer aren't trusted.
+func applyMetadata(file_path string, unix_mode uint32, mod_time time.Time) error {
+	err := os.Chmod(file_path, os.FileMode(unix_mode)&os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("On chmod: %w", err)
+	}
+	if !mod_time.IsZero() {
+		err = os.Chtimes(file_path, mod_time, mod_time)
+		if err != nil {
+			return fmt.Errorf("On chtimes: %w", err)
+		}
+	}
+	return nil
 }
 
 func FromFileInfo(info os.FileInfo) FileInfoJSON {
 	return FileInfoJSON{
 		Name:    info.Name(),
 		Size:    info.Size(),
-		Mode:    info.Mode().String(),
+		Mode:    UnixMode(info.Mode()),
 		ModTime: info.ModTime(),
 		IsDir:   info.IsDir(),
 	}
 
 }
 
+// ParseSize parses a number of bytes with an optional binary unit, e.g. `512`,
+// `100MiB` or `2G`.
+func ParseSize(size string) (int64, error) {
+	units := []struct {
+		suffix string
+		unit   int64
+	}{
+		{"TiB", TiB}, {"GiB", GiB}, {"MiB", MiB}, {"KiB", KiB},
+		{"T", TiB}, {"G", GiB}, {"M", MiB}, {"K", KiB}, {"B", 1},
+	}
+
+	number, unit := strings.TrimSpace(size), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(strings.ToUpper(number), strings.ToUpper(u.suffix)) {
+			number, unit = strings.TrimSpace(number[:len(number)-len(u.suffix)]), u.unit
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/unit {
+		return 0, fmt.Errorf("%w: `%s`", ErrInvalidSize, size)
+	}
+	return n * unit, nil
+}
+
+// NumberOfPartsForSize picks how many parts a file of `size` bytes is split into.
+func NumberOfPartsForSize(size int64) int {
+	parts := (size + MIN_PART_SIZE - 1) / MIN_PART_SIZE
+	return int(max(1, min(parts, MAX_NUMBER_OF_PARTS)))
+}
+
 func BestUnitOfData(data int) (float32, string) {
+	// log10 of 0 is -Inf and of a negative NaN, both are just bytes
+	if data <= 0 {
+		return float32(data), "B"
+	}
 	l := math.Log10(float64(data))
 	switch {
 	case l < 3:
@@ -109,3 +287,36 @@ func tryMakeNewDir(path string) (string, error) {
 		return downloads_dir, nil
 	}
 }
+
+// tryCreateNewFile creates `file_path` without overwriting anything, falling back
+// to `name_1.ext`, `name_2.ext`, ... if the path is already taken.
+func tryCreateNewFile(file_path string) (*os.File, string, error) {
+	ext := path.Ext(file_path)
+	base := strings.TrimSuffix(file_path, ext)
+	for i := 0; ; i++ {
+		var new_file_path string
+		if i == 0 {
+			new_file_path = file_path
+		} else {
+			new_file_path = base + "_" + strconv.Itoa(i) + ext
+		}
+		file, err := os.OpenFile(new_file_path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return nil, "", fmt.Errorf("On create: %w", err)
+		}
+		return file, new_file_path, nil
+	}
+}
+
+// preallocateTruncate sets the size of `file` without reserving disk space, for
+// systems where the space can't be allocated up front.
+func preallocateTruncate(file *os.File, size int64) error {
+	err := file.Truncate(size)
+	if err != nil {
+		return fmt.Errorf("On truncate: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package app
+
+import "testing"
+
+func TestBestUnitOfData(t *testing.T) {
+	tests := []struct {
+		data int
+		size float32
+		unit string
+	}{
+		{-5000, -5000, "B"},
+		{0, 0, "B"},
+		{999, 999, "B"},
+		{1500, 1.5, "Kb"},
+		{2_000_000, 2, "Mb"},
+		{3_000_000_000, 3, "Gb"},
+	}
+	for _, test := range tests {
+		size, unit := BestUnitOfData(test.data)
+		if size != test.size || unit != test.unit {
+			t.Errorf("BestUnitOfData(%d) = %f %s, want %f %s", test.data, size, unit, test.size, test.unit)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrIncompatiblePeer = errors.New("Incompatible peer")
+	ErrHelloTampered    = errors.New("The hello was changed on the way")
+)
+
+// Every connection starts with both sides saying which protocol versions they
+// speak and what they can do. Version 1 was the protocol before the handshake,
+// version 2 sent JSON after an int64 length instead of frames, version 3 set
+// up TLS, pairing and the pre-shared key before the hello.
+const (
+	PROTOCOL_VERSION     = 4
+	MIN_PROTOCOL_VERSION = 4
+	MAX_HELLO_SIZE       = 64 * KiB
+
+	hello_magic = "BDP-HELO"
+)
+
+// Capability is an optional feature of the protocol, both sides have to have
+// it for it to be used.
+type Capability string
+
+const (
+	CapabilityResume   Capability = "resume"
+	CapabilitySparse   Capability = "sparse"
+	CapabilitySessions Capability = "sessions"
+	CapabilityTLS      Capability = "tls"
+	CapabilityPairing  Capability = "pairing"
+	CapabilityPSK      Capability = "psk"
+	// CapabilityMultiplex carries every request on a stream of one connection
+	CapabilityMultiplex Capability = "multiplex"
+)
+
+func compressionCapability(compression Compression) Capability {
+	return Capability("compression:" + string(compression))
+}
+
+func hashCapability(algorithm HashAlgorithm) Capability {
+	return Capability("hash:" + string(algorithm))
+}
+
+// HelloJSON is what each side sends first. The receiver answers with the
+// version and capabilities both agreed on, or why they can't talk.
+type HelloJSON struct {
+	Version      int          `json:"version"`
+	MinVersion   int          `json:"min_version"`
+	Capabilities []Capability `json:"capabilities"`
+	// Requires are the capabilities the sender can't do without
+	Requires []Capability `json:"requires"`
+	Error    string       `json:"error"`
+}
+
+func newHello(capabilities []Capability, requires []Capability) HelloJSON {
+	return HelloJSON{Version: PROTOCOL_VERSION, MinVersion: MIN_PROTOCOL_VERSION, Capabilities: capabilities, Requires: requires}
+}
+
+// agree picks the highest version both sides speak and the capabilities both
+// have, and checks that the sender gets what it requires.
+func (h HelloJSON) agree(peer HelloJSON) (HelloJSON, error) {
+	version := min(h.Version, peer.Version)
+	if version < max(h.MinVersion, peer.MinVersion) {
+		return HelloJSON{}, fmt.Errorf("%w: speaks protocol versions %d-%d, we speak %d-%d",
+			ErrIncompatiblePeer, peer.MinVersion, peer.Version, h.MinVersion, h.Version)
+	}
+
+	agreed := HelloJSON{Version: version, MinVersion: version, Capabilities: []Capability{}}
+	for _, capability := range h.Capabilities {
+		if slices.Contains(peer.Capabilities, capability) {
+			agreed.Capabilities = append(agreed.Capabilities, capability)
+		}
+	}
+
+	missing := []string{}
+	for _, capability := range slices.Concat(h.Requires, peer.Requires) {
+		if !slices.Contains(agreed.Capabilities, capability) {
+			missing = append(missing, string(capability))
+		}
+	}
+	if len(missing) > 0 {
+		return HelloJSON{}, fmt.Errorf("%w: missing %s", ErrIncompatiblePeer, strings.Join(missing, ", "))
+	}
+	return agreed, nil
+}
+
+// hello opens the connection from the sender's side.
+func (conn *Conn) hello(own HelloJSON) error {
+	_, err := conn.Write([]byte(hello_magic))
+	if err != nil {
+		return fmt.Errorf("On write hello: %w", err)
+	}
+	err = conn.sendHello(own)
+	if err != nil {
+		return err
+	}
+
+	agreed, err := conn.receiveHello()
+	if err != nil {
+		return fmt.Errorf("%w: no hello: %w", ErrIncompatiblePeer, err)
+	}
+	if agreed.Error != "" {
+		return fmt.Errorf("%w: %s", ErrIncompatiblePeer, agreed.Error)
+	}
+
+	// The receiver can't agree on more than we offered
+	check, err := own.agree(agreed)
+	if err != nil || check.Version != agreed.Version || len(check.Capabilities) != len(agreed.Capabilities) {
+		return fmt.Errorf("%w: invalid agreement: version %d, %v", ErrIncompatiblePeer, agreed.Version, agreed.Capabilities)
+	}
+
+	conn.version = agreed.Version
+	conn.capabilities = agreed.Capabilities
+	return nil
+}
+
+// acceptHello answers the sender's hello from the receiver's side.
+func (conn *Conn) acceptHello(own HelloJSON) error {
+	magic := make([]byte, len(hello_magic))
+	_, err := io.ReadFull(conn, magic)
+	if err != nil {
+		return fmt.Errorf("On read hello: %w", err)
+	}
+	// A TLS record, version 3 started with the handshake
+	if magic[0] == 0x16 && magic[1] == 0x03 {
+		return fmt.Errorf("%w: TLS before the hello, the peer speaks protocol version 3", ErrIncompatiblePeer)
+	}
+	if !bytes.Equal(magic, []byte(hello_magic)) {
+		return fmt.Errorf("%w: no hello, the peer speaks protocol version 1", ErrIncompatiblePeer)
+	}
+
+	peer, err := conn.receiveHello()
+	if err != nil {
+		return fmt.Errorf("On hello: %w", err)
+	}
+
+	agreed, agree_err := own.agree(peer)
+	if agree_err != nil {
+		// The sender wraps it in ErrIncompatiblePeer again
+		agreed.Error = strings.TrimPrefix(agree_err.Error(), ErrIncompatiblePeer.Error()+": ")
+	}
+	err = conn.sendHello(agreed)
+	if agree_err != nil {
+		return agree_err
+	}
+	if err != nil {
+		return err
+	}
+
+	conn.version = agreed.Version
+	conn.capabilities = agreed.Capabilities
+	return nil
+}
+
+// secured reports whether TLS or pairing protect the connection after the hello.
+func (conn *Conn) secured() bool {
+	return conn.hasCapability(CapabilityTLS) || conn.hasCapability(CapabilityPairing)
+}
+
+// confirmHello sends the sender's hello again once the connection is secured
+// and checks the receiver agreed on the same, the first hello went in the clear
+// where a peer in the middle could have changed it.
+func (conn *Conn) confirmHello(own HelloJSON) error {
+	err := conn.sendHello(own)
+	if err != nil {
+		return err
+	}
+	agreed, err := conn.receiveHello()
+	if err != nil {
+		return err
+	}
+	if agreed.Error != "" || !conn.agreedOn(agreed) {
+		return fmt.Errorf("%w: version %d, %v", ErrHelloTampered, agreed.Version, agreed.Capabilities)
+	}
+	return nil
+}
+
+// acceptConfirmHello is confirmHello from the receiver's side.
+func (conn *Conn) acceptConfirmHello(own HelloJSON) error {
+	peer, err := conn.receiveHello()
+	if err != nil {
+		return err
+	}
+	agreed, agree_err := own.agree(peer)
+	if agree_err != nil || !conn.agreedOn(agreed) {
+		_ = conn.sendHello(HelloJSON{Error: ErrHelloTampered.Error()})
+		return fmt.Errorf("%w: version %d, %v", ErrHelloTampered, peer.Version, peer.Capabilities)
+	}
+	return conn.sendHello(agreed)
+}
+
+// agreedOn reports whether `agreed` is what the connection agreed on.
+func (conn *Conn) agreedOn(agreed HelloJSON) bool {
+	return agreed.Version == conn.version && slices.Equal(agreed.Capabilities, conn.capabilities)
+}
+
+// The hello is JSON after an int64 length, whatever the version, so any peer
+// can read it and tell why it can't talk to us.
+func (conn *Conn) sendHello(hello HelloJSON) error {
+	hello_json, err := json.Marshal(hello)
+	if err != nil {
+		return fmt.Errorf("On marshal hello: %w", err)
+	}
+	err = binary.Write(conn, binary.BigEndian, int64(len(hello_json)))
+	if err != nil {
+		return fmt.Errorf("On write hello size: %w", err)
+	}
+	_, err = conn.Write(hello_json)
+	if err != nil {
+		return fmt.Errorf("On write hello: %w", err)
+	}
+	return nil
+}
+
+func (conn *Conn) receiveHello() (HelloJSON, error) {
+	var size int64
+	err := binary.Read(conn, binary.BigEndian, &size)
+	if err != nil {
+		return HelloJSON{}, fmt.Errorf("On read hello size: %w", err)
+	}
+	if size <= 0 || size > MAX_HELLO_SIZE {
+		return HelloJSON{}, fmt.Errorf("%w: hello of %d bytes", ErrIncompatiblePeer, size)
+	}
+
+	hello_json := make([]byte, size)
+	_, err = io.ReadFull(conn, hello_json)
+	if err != nil {
+		return HelloJSON{}, fmt.Errorf("On read hello: %w", err)
+	}
+	var hello HelloJSON
+	err = json.Unmarshal(hello_json, &hello)
+	if err != nil {
+		return HelloJSON{}, fmt.Errorf("On unmarshal hello: %w", err)
+	}
+	return hello, nil
+}
+
+// hasCapability reports whether both sides of the connection have `capability`.
+func (conn *Conn) hasCapability(capability Capability) bool {
+	return slices.Contains(conn.capabilities, capability)
+}
+
+// hello is what the Listener can do and needs with its current settings.
+func (l *Listener) hello() HelloJSON {
+	capabilities := []Capability{CapabilityResume, CapabilitySparse, CapabilitySessions, CapabilityMultiplex}
+	for _, algorithm := range SUPPORTED_HASH_ALGORITHMS {
+		capabilities = append(capabilities, hashCapability(algorithm))
+	}
+	for _, compression := range l.Compressions {
+		capabilities = append(capabilities, compressionCapability(compression))
+	}
+
+	// A sender that isn't set up the same way is told so by the hello
+	requires := []Capability{}
+	if l.Identity != nil {
+		capabilities = append(capabilities, CapabilityTLS)
+		requires = append(requires, CapabilityTLS)
+	}
+	if l.PairingCode != "" {
+		capabilities = append(capabilities, CapabilityPairing)
+		requires = append(requires, CapabilityPairing)
+	}
+	if len(l.PreSharedKey) > 0 {
+		capabilities = append(capabilities, CapabilityPSK)
+		requires = append(requires, CapabilityPSK)
+	}
+	return newHello(capabilities, requires)
+}
+
+// hello is what the Sender can do and needs with its current settings.
+func (fs *Sender) hello() HelloJSON {
+	capabilities := []Capability{CapabilityResume, CapabilitySparse, CapabilitySessions}
+	for _, algorithm := range SUPPORTED_HASH_ALGORITHMS {
+		capabilities = append(capabilities, hashCapability(algorithm))
+	}
+	for _, compression := range SUPPORTED_COMPRESSIONS {
+		capabilities = append(capabilities, compressionCapability(compression))
+	}
+
+	hash_algorithm := fs.HashAlgorithm
+	if hash_algorithm == "" {
+		hash_algorithm = DEFAULT_HASH_ALGORITHM
+	}
+	requires := []Capability{CapabilitySessions, hashCapability(hash_algorithm)}
+	if fs.Identity != nil {
+		capabilities = append(capabilities, CapabilityTLS)
+		requires = append(requires, CapabilityTLS)
+	}
+	if fs.PairingCode != "" {
+		capabilities = append(capabilities, CapabilityPairing)
+		requires = append(requires, CapabilityPairing)
+	}
+	if len(fs.PreSharedKey) > 0 {
+		capabilities = append(capabilities, CapabilityPSK)
+		requires = append(requires, CapabilityPSK)
+	}
+	// Only offered when wanted, the receiver multiplexes whenever it's agreed on
+	if fs.Multiplex {
+		capabilities = append(capabilities, CapabilityMultiplex)
+		requires = append(requires, CapabilityMultiplex)
+	}
+	return newHello(capabilities, requires)
+}
@@ -0,0 +1,223 @@
+package app
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// memoryPair returns both ends of a connection over a MemoryTransport.
+func memoryPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	transport := NewMemoryTransport()
+	ln, err := transport.Listen(TEST_ADDRESS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dialed := make(chan net.Conn, 1)
+	go func() {
+		client, _ := transport.Dial(TEST_ADDRESS)
+		dialed <- client
+	}()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := <-dialed
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// TestAcceptHello checks the receiver tells every peer it can't talk to that
+// it is incompatible, however old it is.
+func TestAcceptHello(t *testing.T) {
+	hello := func(hello HelloJSON) func(conn net.Conn) {
+		return func(conn net.Conn) {
+			c := NewConn(conn)
+			_, _ = c.Write([]byte(hello_magic))
+			_ = c.sendHello(hello)
+		}
+	}
+
+	tests := []struct {
+		name string
+		peer func(conn net.Conn)
+		want error
+	}{
+		{"current", hello(newHello([]Capability{CapabilitySessions}, []Capability{CapabilitySessions})), nil},
+		{"older version", hello(HelloJSON{Version: 3, MinVersion: 2}), ErrIncompatiblePeer},
+		{"newer version", hello(HelloJSON{Version: 9, MinVersion: 9}), ErrIncompatiblePeer},
+		{"missing a required capability", hello(newHello(nil, []Capability{"compression:lz4"})), ErrIncompatiblePeer},
+		{"version 3 starting with tls", func(conn net.Conn) {
+			_ = tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+		}, ErrIncompatiblePeer},
+		{"version 1", func(conn net.Conn) {
+			_ = binary.Write(conn, binary.BigEndian, int64(100))
+		}, ErrIncompatiblePeer},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := memoryPair(t)
+			go test.peer(client)
+
+			l := NewListener(0, t.TempDir())
+			err := NewConn(server).acceptHello(l.hello())
+			if !errors.Is(err, test.want) {
+				t.Fatalf("Got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// TestHelloOlderReceiver checks the sender tells a receiver it can't talk to
+// apart from one that fails the handshakes after the hello.
+func TestHelloOlderReceiver(t *testing.T) {
+	tests := []struct {
+		name     string
+		receiver func(conn net.Conn)
+	}{
+		{"disagrees", func(conn net.Conn) {
+			c := NewConn(conn)
+			_, _ = c.Read(make([]byte, len(hello_magic)))
+			_, _ = c.receiveHello()
+			_ = c.sendHello(HelloJSON{Error: "speaks protocol versions 4-4, we speak 3-3"})
+		}},
+		{"version 3 starting with tls", func(conn net.Conn) {
+			// Reads the hello as a TLS record and gives up
+			_, _ = conn.Read(make([]byte, 5))
+			_, _ = conn.Write([]byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x0a})
+			conn.Close()
+		}},
+	}
+
+	file_path := filepath.Join(t.TempDir(), "a.bin")
+	writeRandomFile(t, file_path, 1000, 1)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := NewMemoryTransport()
+			ln, err := transport.Listen(TEST_ADDRESS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				test.receiver(conn)
+			}()
+
+			fs := NewTransportFileSender(transport, TEST_ADDRESS)
+			fs.Identity = newTestIdentity(t)
+			defer fs.Close()
+			err = fs.SendFiles([]string{file_path})
+			if !errors.Is(err, ErrIncompatiblePeer) {
+				t.Fatalf("Got %v, want %v", err, ErrIncompatiblePeer)
+			}
+		})
+	}
+}
+
+// TestHelloRequires checks that either side missing TLS, pairing or the
+// pre-shared key the other is set up with fails at the hello.
+func TestHelloRequires(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, l *Listener, fs *Sender)
+	}{
+		{"receiver with tls", func(t *testing.T, l *Listener, fs *Sender) {
+			l.Identity = newTestIdentity(t)
+		}},
+		{"sender with tls", func(t *testing.T, l *Listener, fs *Sender) {
+			fs.Identity = newTestIdentity(t)
+		}},
+		{"receiver with pairing", func(t *testing.T, l *Listener, fs *Sender) {
+			l.PairingCode = newTestPairingCode(t)
+		}},
+		{"sender with pairing", func(t *testing.T, l *Listener, fs *Sender) {
+			fs.PairingCode = newTestPairingCode(t)
+		}},
+		{"sender with a pre-shared key", func(t *testing.T, l *Listener, fs *Sender) {
+			fs.PreSharedKey = []byte("secret")
+		}},
+		{"receiver without the hash", func(t *testing.T, l *Listener, fs *Sender) {
+			fs.HashAlgorithm = "md5"
+		}},
+	}
+
+	file_path := filepath.Join(t.TempDir(), "a.bin")
+	writeRandomFile(t, file_path, 1000, 1)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newTestListener(t)
+			fs := NewTransportFileSender(nil, TEST_ADDRESS)
+			test.setup(t, l, fs)
+			fs.Transport = serveMemory(t, l)
+			defer fs.Close()
+
+			err := fs.SendFiles([]string{file_path})
+			if !errors.Is(err, ErrIncompatiblePeer) {
+				t.Fatalf("Got %v, want %v", err, ErrIncompatiblePeer)
+			}
+		})
+	}
+}
+
+// tamperTransport strips a capability from the first hello a sender sends, as
+// a peer in the middle could.
+type tamperTransport struct {
+	*MemoryTransport
+}
+
+func (tt tamperTransport) Dial(address string) (net.Conn, error) {
+	conn, err := tt.MemoryTransport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return &tamperConn{Conn: conn}, nil
+}
+
+type tamperConn struct {
+	net.Conn
+	tampered bool
+}
+
+func (tc *tamperConn) Write(p []byte) (int, error) {
+	capability := string(compressionCapability(CompressionZstd))
+	if !tc.tampered && strings.Contains(string(p), capability) {
+		tc.tampered = true
+		p = []byte(strings.Replace(string(p), capability, strings.Repeat("x", len(capability)), 1))
+	}
+	return tc.Conn.Write(p)
+}
+
+func (tc *tamperConn) CloseWrite() error {
+	return tc.Conn.(interface{ CloseWrite() error }).CloseWrite()
+}
+
+func TestHelloTampered(t *testing.T) {
+	l := newTestListener(t)
+	l.PairingCode = newTestPairingCode(t)
+	fs := NewTransportFileSender(tamperTransport{serveMemory(t, l)}, TEST_ADDRESS)
+	fs.PairingCode = l.PairingCode
+	defer fs.Close()
+
+	file_path := filepath.Join(t.TempDir(), "a.bin")
+	writeRandomFile(t, file_path, 1000, 1)
+	err := fs.SendFiles([]string{file_path})
+	if !errors.Is(err, ErrHelloTampered) {
+		t.Fatalf("Got %v, want %v", err, ErrHelloTampered)
+	}
+}
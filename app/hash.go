@@ -0,0 +1,80 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/blake3"
+)
+
+var (
+	ErrUnknownHashAlgorithm = errors.New("Unknown hash algorithm")
+	ErrPartHashMismatch     = errors.New("Part hash doesn't match")
+	ErrFileHashMismatch     = errors.New("File hash doesn't match")
+	ErrChunkHashMismatch    = errors.New("Chunk hashes don't match")
+)
+
+type HashAlgorithm string
+
+const (
+	HashSHA256 HashAlgorithm = "sha256"
+	HashXXH64  HashAlgorithm = "xxh64"
+	HashBLAKE3 HashAlgorithm = "blake3"
+
+	DEFAULT_HASH_ALGORITHM = HashSHA256
+)
+
+var SUPPORTED_HASH_ALGORITHMS = []HashAlgorithm{HashSHA256, HashXXH64, HashBLAKE3}
+
+func ParseHashAlgorithm(name string) (HashAlgorithm, error) {
+	algorithm := HashAlgorithm(name)
+	_, err := algorithm.New()
+	if err != nil {
+		return "", err
+	}
+	return algorithm, nil
+}
+
+func (ha HashAlgorithm) New() (hash.Hash, error) {
+	switch ha {
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashXXH64:
+		return xxhash.New(), nil
+	case HashBLAKE3:
+		return blake3.New(), nil
+	default:
+		return nil, fmt.Errorf("%w: `%s`", ErrUnknownHashAlgorithm, ha)
+	}
+}
+
+// fileDigest is the whole file hash and the root of the file's hash tree: the
+// hash of every part hash, in part order. It isn't a hash of the file's bytes
+// as such, those are covered through the tree, so it only matches another file
+// hash made with the same part count and chunk size.
+func fileDigest(algorithm HashAlgorithm, part_hashes []string) (string, error) {
+	h, err := algorithm.New()
+	if err != nil {
+		return "", err
+	}
+
+	for _, part_hash := range part_hashes {
+		raw, err := hex.DecodeString(part_hash)
+		if err != nil {
+			return "", fmt.Errorf("On decode part hash: %w", err)
+		}
+		h.Write(raw)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashesEqual(a string, b string) bool {
+	raw_a, err_a := hex.DecodeString(a)
+	raw_b, err_b := hex.DecodeString(b)
+	return err_a == nil && err_b == nil && bytes.Equal(raw_a, raw_b)
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// hashedParts splits `data` into parts and hashes them like a Sender does.
+func hashedParts(t *testing.T, data []byte, algorithm HashAlgorithm) []FileInfoJSON {
+	t.Helper()
+	file_info := FileInfoJSON{Name: "a.bin", Path: "a.bin", Size: int64(len(data)), Parts: 3,
+		HashAlgorithm: algorithm, ChunkSize: 4 * KiB}
+	part_infos := (&Sender{}).splitFileIntoParts(file_info)
+	_, err := hashFileParts(bytes.NewReader(data), part_infos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return part_infos
+}
+
+func validateHashes(part_info FileInfoJSON) error {
+	err := validateFileInfo(part_info)
+	if err != nil {
+		return err
+	}
+	return validatePartInfo(part_info)
+}
+
+func TestHashFileParts(t *testing.T) {
+	data := make([]byte, 50*KiB+3)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	file_hashes := map[string]bool{}
+	for _, algorithm := range SUPPORTED_HASH_ALGORITHMS {
+		part_infos := hashedParts(t, data, algorithm)
+		for _, part_info := range part_infos {
+			err := validateHashes(part_info)
+			if err != nil {
+				t.Fatalf("%s part %d: %s", algorithm, part_info.PartNumber, err)
+			}
+		}
+		file_hashes[part_infos[0].FileHash] = true
+
+		data[len(data)-1]++
+		changed := hashedParts(t, data, algorithm)
+		data[len(data)-1]--
+		if changed[0].FileHash == part_infos[0].FileHash || changed[2].PartHashes[2] == part_infos[2].PartHashes[2] {
+			t.Fatalf("%s: a changed byte didn't change the hashes", algorithm)
+		}
+	}
+	if len(file_hashes) != len(SUPPORTED_HASH_ALGORITHMS) {
+		t.Fatalf("%d different file hashes for %d algorithms", len(file_hashes), len(SUPPORTED_HASH_ALGORITHMS))
+	}
+}
+
+func TestHashMismatch(t *testing.T) {
+	data := make([]byte, 50*KiB+3)
+	rand.New(rand.NewSource(1)).Read(data)
+	other := hashedParts(t, append([]byte{1}, data[1:]...), HashSHA256)
+
+	tests := []struct {
+		name   string
+		tamper func(part_info *FileInfoJSON)
+		want   error
+	}{
+		{"file hash", func(part_info *FileInfoJSON) {
+			part_info.FileHash = other[0].FileHash
+		}, ErrFileHashMismatch},
+		{"part hash", func(part_info *FileInfoJSON) {
+			part_info.PartHashes = other[0].PartHashes
+		}, ErrFileHashMismatch},
+		{"missing part hash", func(part_info *FileInfoJSON) {
+			part_info.PartHashes = part_info.PartHashes[:2]
+		}, ErrPartHashMismatch},
+		{"chunk hash", func(part_info *FileInfoJSON) {
+			part_info.ChunkHashes[0] = other[0].ChunkHashes[0]
+		}, ErrPartHashMismatch},
+		{"missing chunk hash", func(part_info *FileInfoJSON) {
+			part_info.ChunkHashes = part_info.ChunkHashes[1:]
+		}, ErrChunkHashMismatch},
+		{"other algorithm", func(part_info *FileInfoJSON) {
+			part_info.HashAlgorithm = HashXXH64
+		}, ErrFileHashMismatch},
+		{"unknown algorithm", func(part_info *FileInfoJSON) {
+			part_info.HashAlgorithm = "md5"
+		}, ErrUnknownHashAlgorithm},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			part_info := hashedParts(t, data, HashSHA256)[0]
+			test.tamper(&part_info)
+			err := validateHashes(part_info)
+			if !errors.Is(err, test.want) {
+				t.Fatalf("Got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package app
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+	"sync"
+)
+
+// Every part is hashed in CHUNK_SIZE chunks. The chunk hashes are the leaves of
+// the part's Merkle tree and the part hash is its root, so a receiver can tell
+// exactly which chunks of a part are corrupt and ask only for those again.
+//
+// The sender hashes a file before sending it, not while its parts stream as
+// first planned: the header has to carry the hashes so the receiver can check
+// every chunk as it arrives and the chunks kept from an earlier attempt before
+// resuming. The price is that every file is read from disk twice.
+//
+// Leaves and nodes are prefixed so a leaf can't be passed off as a node.
+const (
+	merkle_leaf_prefix byte = 0x00
+	merkle_node_prefix byte = 0x01
+)
+
+// merkleRoot returns the root of the tree over `leaves`, an odd node is carried
+// up to the next level as is.
+func merkleRoot(algorithm HashAlgorithm, leaves []string) (string, error) {
+	h, err := algorithm.New()
+	if err != nil {
+		return "", err
+	}
+
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		level[i], err = hex.DecodeString(leaf)
+		if err != nil {
+			return "", fmt.Errorf("On decode chunk hash: %w", err)
+		}
+	}
+	if len(level) == 0 {
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h.Reset()
+			h.Write([]byte{merkle_node_prefix})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0]), nil
+}
+
+// chunkRange returns the byte range of a chunk of the part in the file.
+func chunkRange(part_info FileInfoJSON, chunk int) FileRange {
+	offset := int64(chunk) * part_info.ChunkSize
+	length := min(part_info.ChunkSize, part_info.Length-offset)
+	return FileRange{Offset: part_info.Offset + offset, Length: length}
+}
+
+func numberOfChunks(length int64, chunk_size int64) int {
+	return int((length + chunk_size - 1) / chunk_size)
+}
+
+// holeChunks returns the chunks of a part that don't overlap any of the data
+// `extents` of the file, so they are all zeros.
+func holeChunks(part_info FileInfoJSON, extents []FileRange) []int {
+	holes := []int{}
+	e := 0
+	for chunk := range numberOfChunks(part_info.Length, part_info.ChunkSize) {
+		chunk_range := chunkRange(part_info, chunk)
+		for e < len(extents) && extents[e].End() <= chunk_range.Offset {
+			e++
+		}
+		if e == len(extents) || extents[e].Offset >= chunk_range.End() {
+			holes = append(holes, chunk)
+		}
+	}
+	return holes
+}
+
+func (fi FileInfoJSON) isHoleChunk(chunk int) bool {
+	_, found := slices.BinarySearch(fi.HoleChunks, chunk)
+	return found
+}
+
+// chunkRun is a run of consecutive chunks `[first, last)` of a part that are
+// either all holes or all data. Only data runs go over the wire.
+type chunkRun struct {
+	first int
+	last  int
+	hole  bool
+}
+
+// chunkRuns splits the chunks of a part from `first_chunk` on into runs.
+func chunkRuns(part_info FileInfoJSON, first_chunk int) []chunkRun {
+	runs := []chunkRun{}
+	for chunk := first_chunk; chunk < numberOfChunks(part_info.Length, part_info.ChunkSize); chunk++ {
+		hole := part_info.isHoleChunk(chunk)
+		if len(runs) > 0 && runs[len(runs)-1].hole == hole {
+			runs[len(runs)-1].last++
+			continue
+		}
+		runs = append(runs, chunkRun{first: chunk, last: chunk + 1, hole: hole})
+	}
+	return runs
+}
+
+// fileRange returns the bytes of the file covered by the run.
+func (cr chunkRun) fileRange(part_info FileInfoJSON) FileRange {
+	first := chunkRange(part_info, cr.first)
+	last := chunkRange(part_info, cr.last-1)
+	return FileRange{Offset: first.Offset, Length: last.End() - first.Offset}
+}
+
+// zero_leaves caches the chunk hash of a hole, by algorithm and chunk length.
+var zero_leaves sync.Map
+
+func zeroLeaf(algorithm HashAlgorithm, length int64) (string, error) {
+	key := fmt.Sprintf("%s/%d", algorithm, length)
+	leaf, ok := zero_leaves.Load(key)
+	if ok {
+		return leaf.(string), nil
+	}
+
+	h, err := algorithm.New()
+	if err != nil {
+		return "", err
+	}
+	h.Write([]byte{merkle_leaf_prefix})
+	zeros := make([]byte, min(length, TEMP_B_SIZE))
+	for remaining := length; remaining > 0; remaining -= int64(len(zeros)) {
+		h.Write(zeros[:min(remaining, int64(len(zeros)))])
+	}
+
+	zero_leaf := hex.EncodeToString(h.Sum(nil))
+	zero_leaves.Store(key, zero_leaf)
+	return zero_leaf, nil
+}
+
+// chunkHasher hashes everything written to it chunk by chunk. It must start on
+// a chunk boundary.
+type chunkHasher struct {
+	chunk_size int64
+	h          hash.Hash
+	filled     int64
+	leaves     []string
+}
+
+func newChunkHasher(algorithm HashAlgorithm, chunk_size int64) (*chunkHasher, error) {
+	h, err := algorithm.New()
+	if err != nil {
+		return nil, err
+	}
+	ch := &chunkHasher{chunk_size: chunk_size, h: h}
+	ch.h.Write([]byte{merkle_leaf_prefix})
+	return ch, nil
+}
+
+func (ch *chunkHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := min(int64(len(p)), ch.chunk_size-ch.filled)
+		ch.h.Write(p[:take])
+		ch.filled += take
+		p = p[take:]
+
+		if ch.filled == ch.chunk_size {
+			ch.endChunk()
+		}
+	}
+	return n, nil
+}
+
+func (ch *chunkHasher) endChunk() {
+	ch.leaves = append(ch.leaves, hex.EncodeToString(ch.h.Sum(nil)))
+	ch.h.Reset()
+	ch.h.Write([]byte{merkle_leaf_prefix})
+	ch.filled = 0
+}
+
+// zeroChunk adds a chunk of `length` zeros without hashing them again. It must
+// be called on a chunk boundary.
+func (ch *chunkHasher) zeroChunk(algorithm HashAlgorithm, length int64) error {
+	leaf, err := zeroLeaf(algorithm, length)
+	if err != nil {
+		return err
+	}
+	ch.leaves = append(ch.leaves, leaf)
+	return nil
+}
+
+// Leaves returns the hash of every chunk written, including a last partial one.
+func (ch *chunkHasher) Leaves() []string {
+	if ch.filled > 0 {
+		ch.endChunk()
+	}
+	return ch.leaves
+}
+
+// hashChunks returns the hashes of the chunks `[0, last)` of a part in `r`. Hole
+// chunks aren't read, they are known to be zeros.
+func hashChunks(r io.ReaderAt, part_info FileInfoJSON, last int) ([]string, error) {
+	ch, err := newChunkHasher(part_info.HashAlgorithm, part_info.ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, TEMP_B_SIZE)
+	for _, run := range chunkRuns(part_info, 0) {
+		if run.first >= last {
+			break
+		}
+		run.last = min(run.last, last)
+
+		if run.hole {
+			for chunk := run.first; chunk < run.last; chunk++ {
+				err = ch.zeroChunk(part_info.HashAlgorithm, chunkRange(part_info, chunk).Length)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		run_range := run.fileRange(part_info)
+		_, err = io.CopyBuffer(ch, io.NewSectionReader(r, run_range.Offset, run_range.Length), buf)
+		if err != nil {
+			return nil, fmt.Errorf("On hash chunks: %w", err)
+		}
+	}
+	return ch.Leaves(), nil
+}
+
+// hashFileParts builds the hash tree of every part concurrently, reading the
+// whole file once. It fills in the chunk hashes and part hashes of `part_infos`
+// and returns the file hash.
+func hashFileParts(file io.ReaderAt, part_infos []FileInfoJSON) (string, error) {
+	if len(part_infos) == 0 {
+		return "", nil
+	}
+	algorithm := part_infos[0].HashAlgorithm
+
+	type partHash struct {
+		part_num     int
+		chunk_hashes []string
+		part_hash    string
+		err          error
+	}
+	results := make(chan partHash, len(part_infos))
+	for i, part_info := range part_infos {
+		go func() {
+			chunk_hashes, err := hashChunks(file, part_info, numberOfChunks(part_info.Length, part_info.ChunkSize))
+			if err != nil {
+				results <- partHash{part_num: i, err: err}
+				return
+			}
+			part_hash, err := merkleRoot(algorithm, chunk_hashes)
+			results <- partHash{part_num: i, chunk_hashes: chunk_hashes, part_hash: part_hash, err: err}
+		}()
+	}
+
+	part_hashes := make([]string, len(part_infos))
+	var first_err error
+	for range part_infos {
+		result := <-results
+		if result.err != nil {
+			if first_err == nil {
+				first_err = fmt.Errorf("On part %d: %w", result.part_num, result.err)
+			}
+			continue
+		}
+		part_infos[result.part_num].ChunkHashes = result.chunk_hashes
+		part_hashes[result.part_num] = result.part_hash
+	}
+	if first_err != nil {
+		return "", first_err
+	}
+
+	file_hash, err := fileDigest(algorithm, part_hashes)
+	if err != nil {
+		return "", err
+	}
+	for i := range part_infos {
+		part_infos[i].PartHashes = part_hashes
+		part_infos[i].FileHash = file_hash
+	}
+	return file_hash, nil
+}
+
+// ChunkRequestJSON is the receiver's reply after a part body: the chunks that
+// didn't match and have to be sent again. No chunks means the part is verified.
+//
+//go:generate easytags $GOFILE
+type ChunkRequestJSON struct {
+	Chunks []int `json:"chunks"`
+	Failed bool  `json:"failed"`
+}
@@ -0,0 +1,125 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// corruptTransport flips a byte of `marker` in what is written to the receiver,
+// the first `times` times it goes by. It counts every time it goes by and
+// everything written.
+type corruptTransport struct {
+	Transport
+	marker  []byte
+	times   int
+	seen    int
+	written int64
+	mu      sync.Mutex
+}
+
+func (ct *corruptTransport) Dial(address string) (net.Conn, error) {
+	conn, err := ct.Transport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return &corruptConn{Conn: conn, transport: ct}, nil
+}
+
+type corruptConn struct {
+	net.Conn
+	transport *corruptTransport
+}
+
+func (cc *corruptConn) Write(p []byte) (int, error) {
+	ct := cc.transport
+	ct.mu.Lock()
+	ct.written += int64(len(p))
+	if i := bytes.Index(p, ct.marker); i >= 0 {
+		if ct.seen < ct.times {
+			p = bytes.Clone(p)
+			p[i] ^= 0xff
+		}
+		ct.seen++
+	}
+	ct.mu.Unlock()
+	return cc.Conn.Write(p)
+}
+
+func (cc *corruptConn) CloseWrite() error {
+	return cc.Conn.(interface{ CloseWrite() error }).CloseWrite()
+}
+
+func TestChunkRetransmission(t *testing.T) {
+	const size = 8 * MiB
+	tests := []struct {
+		name string
+		// How many times the chunk is corrupted
+		times int
+		want  error
+	}{
+		{"once", 1, nil},
+		{"every round but the last", MAX_CHUNK_ROUNDS, nil},
+		{"every round", MAX_CHUNK_ROUNDS + 1, ErrChecksumMismatch},
+	}
+
+	file_path := filepath.Join(t.TempDir(), "a.bin")
+	writeRandomFile(t, file_path, int(size), 7)
+	data, err := os.ReadFile(file_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The start of the third chunk of the second part
+	marker := data[5*CHUNK_SIZE : 5*CHUNK_SIZE+64]
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newTestListener(t)
+			corrupt := &corruptTransport{Transport: serveMemory(t, l), marker: marker, times: test.times}
+			fs := NewTransportFileSender(corrupt, TEST_ADDRESS)
+			fs.Parts = 2
+			defer fs.Close()
+
+			err := fs.SendFiles([]string{file_path})
+			if test.want != nil {
+				if !errors.Is(err, test.want) {
+					t.Fatalf("Got %v, want %v", err, test.want)
+				}
+				if corrupt.seen != MAX_CHUNK_ROUNDS+1 {
+					t.Fatalf("The chunk was sent %d times, want %d", corrupt.seen, MAX_CHUNK_ROUNDS+1)
+				}
+				_, err = os.Stat(filepath.Join(l.DownloadsDir, "a.bin"))
+				if !os.IsNotExist(err) {
+					t.Fatalf("The unverified file was kept: %v", err)
+				}
+
+				// Nothing is left stuck on the receiver
+				fs := NewTransportFileSender(corrupt.Transport, TEST_ADDRESS)
+				defer fs.Close()
+				err = fs.SendFiles([]string{file_path})
+				if err != nil {
+					t.Fatalf("Sending again: %s", err)
+				}
+				assertSameFile(t, file_path, filepath.Join(l.DownloadsDir, "a.bin"))
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSameFile(t, file_path, filepath.Join(l.DownloadsDir, "a.bin"))
+
+			// The bad chunk and nothing else is sent again, once per corruption
+			if corrupt.seen != test.times+1 {
+				t.Fatalf("The chunk was sent %d times, want %d", corrupt.seen, test.times+1)
+			}
+			resent := corrupt.written - size
+			if resent < int64(test.times)*CHUNK_SIZE || resent > int64(test.times)*CHUNK_SIZE+64*KiB {
+				t.Fatalf("Sent %d bytes over the file size, want %d chunks", resent, test.times)
+			}
+		})
+	}
+}
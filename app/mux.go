@@ -0,0 +1,100 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/yamux"
+
+	log "github.com/NikosGour/logging/src"
+)
+
+// How much of a stream can be in flight before the receiver reads it, every
+// part gets its own window so a slow one doesn't hold up the rest
+const MUX_STREAM_WINDOW = 16 * MiB
+
+func muxConfig() *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.MaxStreamWindowSize = uint32(MUX_STREAM_WINDOW)
+	config.LogOutput = io.Discard
+	return config
+}
+
+// muxStream is a stream of a multiplexed connection. Closing it only closes
+// our side, the peer can still answer until it closes its side too.
+type muxStream struct {
+	*yamux.Stream
+}
+
+func (ms muxStream) CloseWrite() error {
+	return ms.Stream.Close()
+}
+
+// streamConn is the Conn of a stream carried by `conn`, it shares what was
+// agreed in the handshake of `conn`.
+func (conn *Conn) streamConn(stream *yamux.Stream) *Conn {
+	c := NewConn(muxStream{stream})
+	c.version = conn.version
+	c.capabilities = conn.capabilities
+	c.json_frames = conn.json_frames
+	c.carrier = conn
+	return c
+}
+
+// serveMultiplexed handles every stream the sender opens on `conn` as a
+// request of its own, until the sender closes the connection.
+func (l *Listener) serveMultiplexed(conn *Conn) {
+	// The underlying connection, so streams know the address of the peer
+	session, err := yamux.Server(conn.c, muxConfig())
+	if err != nil {
+		log.Error("%s", fmt.Errorf("On multiplex: %w", err))
+		return
+	}
+	defer session.Close()
+	log.Debug("Multiplexing `%s`", conn.remoteAddr())
+
+	for {
+		stream, err := session.AcceptStream()
+		if errors.Is(err, io.EOF) || errors.Is(err, yamux.ErrSessionShutdown) {
+			return
+		}
+		if err != nil {
+			log.Error("%s", fmt.Errorf("On accept stream from `%s`: %w", conn.remoteAddr(), err))
+			return
+		}
+
+		go func() {
+			stream_conn := conn.streamConn(stream)
+			defer stream_conn.Close()
+			l.handleRequest(stream_conn)
+		}()
+	}
+}
+
+// connectMultiplexed opens a stream on the Sender's connection, dialing it
+// first if there is none yet.
+func (fs *Sender) connectMultiplexed() (*Conn, error) {
+	fs.mux_mu.Lock()
+	defer fs.mux_mu.Unlock()
+
+	if fs.mux == nil || fs.mux.IsClosed() {
+		conn, err := fs.dial()
+		if err != nil {
+			return nil, err
+		}
+		session, err := yamux.Client(conn.c, muxConfig())
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("On multiplex: %w", err)
+		}
+		fs.mux = session
+		fs.mux_conn = conn
+	}
+
+	stream, err := fs.mux.OpenStream()
+	if err != nil {
+		return nil, fmt.Errorf("On open stream: %w", err)
+	}
+	return fs.mux_conn.streamConn(stream), nil
+}
@@ -0,0 +1,233 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/google/uuid"
+
+	log "github.com/NikosGour/logging/src"
+)
+
+// MAX_OFFER_FILES is the most entries an offer can have.
+const MAX_OFFER_FILES = 1_000_000
+
+var (
+	ErrOfferDeclined = errors.New("The receiver declined the transfer")
+	ErrNotOffered    = errors.New("Not part of an accepted offer")
+)
+
+// OfferJSON is the manifest of a session: everything a sender is about to send.
+// The receiver accepts or declines it before anything is written.
+type OfferJSON struct {
+	Name  string         `json:"name"`
+	Files []FileInfoJSON `json:"files"`
+
+	// Peer is the address, and fingerprint over TLS, the offer came from
+	Peer string `json:"-"`
+}
+
+type OfferReplyJSON struct {
+	Accepted bool   `json:"accepted"`
+	Reason   string `json:"reason"`
+	Session  UUID   `json:"session"`
+}
+
+// TotalSize is the size of all the regular files in the offer.
+func (o OfferJSON) TotalSize() int64 {
+	var size int64
+	for _, file_info := range o.Files {
+		if file_info.requestType() == RequestSendFile {
+			size += file_info.Size
+		}
+	}
+	return size
+}
+
+// FileCount is the number of regular files in the offer.
+func (o OfferJSON) FileCount() int {
+	count := 0
+	for _, file_info := range o.Files {
+		if file_info.requestType() == RequestSendFile {
+			count++
+		}
+	}
+	return count
+}
+
+// requestType is the request an entry of an offer is sent with.
+func (fi FileInfoJSON) requestType() RequestType {
+	switch {
+	case fi.IsDir:
+		return RequestMakeDir
+	case fi.LinkTarget != "":
+		return RequestMakeSymlink
+	default:
+		return RequestSendFile
+	}
+}
+
+// sendOffer asks the receiver to accept `files`, it returns the session every
+// request that follows has to carry.
+func (fs *Sender) sendOffer(files []FileInfoJSON) (UUID, error) {
+	name, _ := os.Hostname()
+	offer := OfferJSON{Name: name, Files: files}
+
+	conn, err := fs.connect()
+	if err != nil {
+		return UUID{}, err
+	}
+	defer conn.Close()
+	fs.capabilities = conn.capabilities
+
+	log.Info("Offering %d files, %d bytes, waiting for the receiver to accept", offer.FileCount(), offer.TotalSize())
+	_, err = conn.SendMessage(offer, RequestHeader{UUID: uuid.New(), RequestType: RequestOffer})
+	if err != nil {
+		return UUID{}, err
+	}
+
+	reply, err := receiveMessage[OfferReplyJSON](conn)
+	if err != nil {
+		return UUID{}, fmt.Errorf("On offer reply: %w", err)
+	}
+	err = conn.receiveStatus()
+	if err != nil {
+		return UUID{}, err
+	}
+	if !reply.Accepted {
+		return UUID{}, fmt.Errorf("%w: %s", ErrOfferDeclined, reply.Reason)
+	}
+	return reply.Session, nil
+}
+
+// replyOffer decides on an offer and tells the sender.
+func (conn *Conn) replyOffer(l *Listener) error {
+	offer, err := receiveMessage[OfferJSON](conn)
+	if err != nil {
+		return err
+	}
+	offer.Peer = conn.remoteAddr()
+	fingerprint := conn.peerFingerprint()
+	if fingerprint != "" {
+		offer.Peer += " (" + fingerprint + ")"
+	}
+
+	err = validateOffer(offer)
+	if err != nil {
+		_, _ = conn.sendMessage(OfferReplyJSON{Reason: err.Error()})
+		return err
+	}
+
+	reply := OfferReplyJSON{}
+	reply.Accepted, reply.Reason = l.decide(offer, conn.remoteHost(), fingerprint)
+	if reply.Accepted {
+		reply.Session = uuid.New()
+		sess := newSession(reply.Session, offer, conn.remoteHost(), fingerprint)
+		sess.on_complete = l.SessionComplete
+		l.sessions.Set(reply.Session, sess)
+		l.expireWhenIdle(sess)
+		log.Info("Accepted %d files, %d bytes from `%s` as session %s", offer.FileCount(), offer.TotalSize(), offer.Peer, reply.Session)
+	} else {
+		log.Warn("Declined %d files, %d bytes from `%s`: %s", offer.FileCount(), offer.TotalSize(), offer.Peer, reply.Reason)
+	}
+
+	_, err = conn.sendMessage(reply)
+	return err
+}
+
+// validateOffer checks every entry of an offer before the policy looks at its
+// total, a negative or overflowing size would sneak it under MaxSize.
+func validateOffer(offer OfferJSON) error {
+	if len(offer.Files) > MAX_OFFER_FILES {
+		return fmt.Errorf("%w: %d files, at most %d", ErrInvalidSize, len(offer.Files), MAX_OFFER_FILES)
+	}
+	var total int64
+	offered := make(map[string]bool, len(offer.Files))
+	for _, file_info := range offer.Files {
+		err := validateFilePath(file_info)
+		if err != nil {
+			return err
+		}
+		// The session tracks every entry by its path
+		rel_path := path.Clean(file_info.relPath())
+		if offered[rel_path] {
+			return fmt.Errorf("%w: `%s` is offered twice", ErrInvalidFilePath, rel_path)
+		}
+		offered[rel_path] = true
+		if file_info.Size < 0 || file_info.Parts < 0 || file_info.Offset < 0 || file_info.Length < 0 {
+			return fmt.Errorf("%w: `%s` of %d bytes, %d parts, range %d+%d", ErrInvalidSize,
+				file_info.relPath(), file_info.Size, file_info.Parts, file_info.Offset, file_info.Length)
+		}
+		if file_info.Size > math.MaxInt64-total {
+			return fmt.Errorf("%w: the offer is over %d bytes", ErrInvalidSize, int64(math.MaxInt64))
+		}
+		total += file_info.Size
+	}
+	return nil
+}
+
+// decide applies the Listener's policy to an offer and asks `Prompt` about
+// the offers the policy leaves open.
+func (l *Listener) decide(offer OfferJSON, host string, fingerprint string) (bool, string) {
+	if len(l.AllowedPeers) > 0 && !slices.Contains(l.AllowedPeers, host) &&
+		(fingerprint == "" || !slices.Contains(l.AllowedPeers, fingerprint)) {
+		return false, "peer isn't allowed"
+	}
+	if l.MaxSize > 0 && offer.TotalSize() > l.MaxSize {
+		return false, fmt.Sprintf("%d bytes is over the limit of %d", offer.TotalSize(), l.MaxSize)
+	}
+	if l.AutoAccept || l.Prompt == nil {
+		return true, ""
+	}
+
+	// One question at a time
+	l.prompt_mu.Lock()
+	defer l.prompt_mu.Unlock()
+	if !l.Prompt(offer) {
+		return false, "declined by the user"
+	}
+	return true, ""
+}
+
+// checkOffered checks that `file_info` was part of the offer of the session the
+// request carries, from the same peer, and hasn't changed since.
+func (l *Listener) checkOffered(conn *Conn, request_header RequestHeader, file_info FileInfoJSON) (*session, error) {
+	sess, err := l.getSession(conn, request_header)
+	if err != nil {
+		return nil, err
+	}
+
+	offered, ok := sess.files[file_info.relPath()]
+	if !ok {
+		return nil, fmt.Errorf("%w: `%s`", ErrNotOffered, file_info.relPath())
+	}
+
+	request_type := request_header.RequestType
+	if request_type == RequestResumeQuery {
+		request_type = RequestSendFile
+	}
+	if offered.info.requestType() != request_type || file_info.requestType() != request_type ||
+		offered.info.LinkTarget != file_info.LinkTarget ||
+		(request_type == RequestSendFile && offered.info.Size != file_info.Size) ||
+		(offered.info.FileHash != "" && offered.info.FileHash != file_info.FileHash) {
+		return nil, fmt.Errorf("%w: `%s` changed since the offer", ErrNotOffered, file_info.relPath())
+	}
+	return sess, nil
+}
+
+// getSession returns the session the request is part of, if the same peer started it.
+func (l *Listener) getSession(conn *Conn, request_header RequestHeader) (*session, error) {
+	sess, ok := l.sessions.Get(request_header.Session)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown session %s", ErrNotOffered, request_header.Session)
+	}
+	if sess.host != conn.remoteHost() || sess.fingerprint != conn.peerFingerprint() {
+		return nil, fmt.Errorf("%w: session %s was started by another peer", ErrNotOffered, request_header.Session)
+	}
+	sess.touch()
+	return sess, nil
+}
@@ -0,0 +1,138 @@
+package app
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOfferRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		max_size int64
+		files    []FileInfoJSON
+		accepted bool
+		want     error
+	}{
+		{"within the limit", 2000, []FileInfoJSON{{Name: "a.bin", Size: 1000}}, true, nil},
+		{"over the limit", 10, []FileInfoJSON{{Name: "a.bin", Size: 1000}}, false, nil},
+		{"negative entry under the limit", 10,
+			[]FileInfoJSON{{Name: "a.bin", Size: 1000}, {Name: "phantom.bin", Size: -100000}}, false, ErrInvalidMetadata},
+		{"negative size", 0, []FileInfoJSON{{Name: "a.bin", Size: -5000}}, false, ErrInvalidMetadata},
+		{"negative parts", 0, []FileInfoJSON{{Name: "a.bin", Size: 10, Parts: -1}}, false, ErrInvalidMetadata},
+		{"negative range", 0, []FileInfoJSON{{Name: "a.bin", Size: 10, Offset: -1, Length: -1}}, false, ErrInvalidMetadata},
+		{"overflowing total", 10,
+			[]FileInfoJSON{{Name: "a.bin", Size: math.MaxInt64}, {Name: "b.bin", Size: math.MaxInt64}}, false, ErrInvalidMetadata},
+		{"parent dir", 0, []FileInfoJSON{{Name: "a.bin", Path: "../a.bin"}}, false, ErrInvalidMetadata},
+		{"absolute path", 0, []FileInfoJSON{{Name: "passwd", Path: "/etc/passwd"}}, false, ErrInvalidMetadata},
+		{"slash in name", 0, []FileInfoJSON{{Name: "a/b.bin"}}, false, ErrInvalidMetadata},
+		{"dot name", 0, []FileInfoJSON{{Name: ".."}}, false, ErrInvalidMetadata},
+		{"duplicate path", 0,
+			[]FileInfoJSON{{Name: "a.bin", Size: 10}, {Name: "b.bin", Path: "a.bin", Size: 20}}, false, ErrInvalidMetadata},
+		{"duplicate path spelled differently", 0,
+			[]FileInfoJSON{{Name: "b.bin", Path: "a/b.bin"}, {Name: "b.bin", Path: "a/./b.bin"}}, false, ErrInvalidMetadata},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newTestListener(t)
+			l.MaxSize = test.max_size
+			transport := serveMemory(t, l)
+
+			reply, err := sendRawOffer(t, transport, test.files)
+			if !errors.Is(err, test.want) {
+				t.Fatalf("Got %v, want %v", err, test.want)
+			}
+			if reply.Accepted != test.accepted {
+				t.Fatalf("Accepted is %t, want %t: %s", reply.Accepted, test.accepted, reply.Reason)
+			}
+		})
+	}
+}
+
+func TestOfferPolicy(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(l *Listener)
+		want  error
+	}{
+		{"no policy", func(l *Listener) {}, nil},
+		{"over the limit", func(l *Listener) { l.AutoAccept = true; l.MaxSize = 100 }, ErrOfferDeclined},
+		{"allowed peer", func(l *Listener) { l.AutoAccept = true; l.AllowedPeers = []string{"memory"} }, nil},
+		{"peer not allowed", func(l *Listener) { l.AutoAccept = true; l.AllowedPeers = []string{"192.0.2.1"} }, ErrOfferDeclined},
+		{"accepted by the prompt", func(l *Listener) { l.Prompt = func(OfferJSON) bool { return true } }, nil},
+		{"declined by the prompt", func(l *Listener) { l.Prompt = func(OfferJSON) bool { return false } }, ErrOfferDeclined},
+		{"not asked with auto accept", func(l *Listener) {
+			l.AutoAccept = true
+			l.Prompt = func(OfferJSON) bool { return false }
+		}, nil},
+	}
+
+	file_path := filepath.Join(t.TempDir(), "a.bin")
+	writeRandomFile(t, file_path, 1000, 1)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := NewListener(0, t.TempDir())
+			test.setup(l)
+			fs := NewTransportFileSender(serveMemory(t, l), TEST_ADDRESS)
+			defer fs.Close()
+
+			err := fs.SendFiles([]string{file_path})
+			if !errors.Is(err, test.want) {
+				t.Fatalf("Got %v, want %v", err, test.want)
+			}
+			_, err = os.Stat(filepath.Join(l.DownloadsDir, "a.bin"))
+			if (test.want == nil) != (err == nil) {
+				t.Fatalf("Received is %t, want %t", err == nil, test.want == nil)
+			}
+		})
+	}
+}
+
+// TestAllowedFingerprint allows a sender by the fingerprint of its TLS identity,
+// however the connection is wrapped.
+func TestAllowedFingerprint(t *testing.T) {
+	tests := []struct {
+		name      string
+		pairing   bool
+		multiplex bool
+		allowed   bool
+	}{
+		{"tls", false, false, true},
+		{"tls and pairing", true, false, true},
+		{"tls and pairing multiplexed", true, true, true},
+		{"other fingerprint", true, false, false},
+	}
+
+	file_path := filepath.Join(t.TempDir(), "a.bin")
+	writeRandomFile(t, file_path, 1000, 1)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newTestListener(t)
+			l.Identity = newTestIdentity(t)
+			fs := NewTransportFileSender(serveMemory(t, l), TEST_ADDRESS)
+			fs.Identity = newTestIdentity(t)
+			fs.Fingerprint = l.Identity.Fingerprint
+			fs.Multiplex = test.multiplex
+			defer fs.Close()
+			if test.pairing {
+				l.PairingCode = newTestPairingCode(t)
+				fs.PairingCode = l.PairingCode
+			}
+			l.AllowedPeers = []string{l.Identity.Fingerprint}
+			if test.allowed {
+				l.AllowedPeers = []string{fs.Identity.Fingerprint}
+			}
+
+			err := fs.SendFiles([]string{file_path})
+			if test.allowed && err != nil {
+				t.Fatal(err)
+			}
+			if !test.allowed && !errors.Is(err, ErrOfferDeclined) {
+				t.Fatalf("Got %v, want %v", err, ErrOfferDeclined)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package app
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/NikosGour/logging/src"
+)
+
+var (
+	ErrInvalidPairingCode = errors.New("Invalid pairing code")
+	ErrNotPairing         = errors.New("Peer didn't start a pairing")
+	ErrInvalidRecord      = errors.New("Invalid encrypted record")
+)
+
+const (
+	PAIRING_CODE_WORDS = 2
+	MAX_PAIRING_NUMBER = 99
+	PAIRED_RECORD_SIZE = int(64 * KiB)
+
+	pairing_magic      = "BDP-PAKE"
+	pake_message_size  = 32
+	pake_confirm_size  = 32
+	paired_header_size = 4
+)
+
+var pairing_words = []string{
+	"aardvark", "absurd", "accrue", "acme", "adrift", "adult", "afflict", "ahead",
+	"aimless", "algol", "allow", "alone", "ammo", "ancient", "apple", "artist",
+	"assume", "athens", "atlas", "aztec", "baboon", "backfield", "backward",
+	"banjo", "beaming", "bedlamp", "beehive", "beeswax", "befriend", "belfast",
+	"berserk", "billiard", "bison", "blackjack", "blockade", "blowtorch",
+	"bluebird", "bombast", "bookshelf", "brackish", "breadline", "breakup",
+	"brickyard", "briefcase", "burbank", "button", "buzzard", "cement",
+	"chairlift", "chatter", "checkup", "chisel", "choking", "chopper",
+	"christmas", "clamshell", "classic", "classroom", "cleanup", "clockwork",
+	"cobra", "commence", "concert", "cowbell", "crackdown", "cranky", "crowfoot",
+	"crucial", "crumpled", "crusade", "cubic", "dashboard", "deadbolt",
+	"deckhand", "dogsled", "dragnet", "drainage", "dreadful", "drifter",
+	"dropper", "drumbeat", "drunken", "dupont", "dwelling", "eating", "edict",
+	"egghead", "eightball", "endorse", "endow", "enlist", "erase", "escape",
+	"exceed", "eyeglass", "eyetooth", "facial", "fallout", "flagpole", "flatfoot",
+	"flytrap", "fracture", "framework", "freedom", "frighten", "gazelle",
+	"geiger", "glitter", "glucose", "goggles", "goldfish", "gremlin", "guidance",
+	"hamlet", "highchair", "hockey", "indoors", "indulge", "inverse", "involve",
+	"island", "jawbone", "keyboard", "kickoff", "kiwi", "klaxon", "locale",
+	"lockup", "merit", "minnow", "miser", "mohawk", "mural", "music", "necklace",
+	"neptune", "newborn", "nightbird", "oakland", "obtuse", "offload", "optic",
+	"orca", "payday", "peachy", "pheasant", "physique", "playhouse", "pluto",
+	"preclude", "prefer", "preshrunk", "printer", "prowler", "pupil", "puppy",
+	"python", "quadrant", "quiver", "quota", "ragtime", "ratchet", "rebirth",
+	"reform", "regain", "reindeer", "rematch", "repay", "retouch", "revenge",
+	"reward", "rhythm", "ribcage", "ringbolt", "robust", "rocker", "ruffled",
+	"sailboat", "sawdust", "scallion", "scenic", "scorecard", "scotland",
+	"seabird", "select", "sentence", "shadow", "shamrock", "showgirl", "skullcap",
+	"skydive", "slingshot", "slowdown", "snapline", "snapshot", "snowcap",
+	"snowslide", "solo", "southward", "soybean", "spaniel", "spearhead",
+	"spellbind", "spheroid", "spigot", "spindle", "spyglass", "stagehand",
+	"stagnate", "stairway", "standard", "stapler", "steamship", "sterling",
+	"stockman", "stopwatch", "stormy", "sugar", "surmount", "suspense",
+	"sweatband", "swelter", "tactics", "talon", "tapeworm", "tempest", "tiger",
+	"tissue", "tonic", "topmost", "tracker", "transit", "trauma", "treadmill",
+	"trojan", "trouble", "tumor", "tunnel", "tycoon", "uncut", "unearth",
+	"unwind", "uproot", "upset", "upshot", "vapor", "village", "virus", "vulcan",
+	"waffle", "wallet", "watchword", "wayside", "willow", "woodlark", "zulu",
+}
+
+// NewPairingCode returns a short code like `7-crossover-clockwork` to be read
+// out to the sender.
+func NewPairingCode() (string, error) {
+	number, err := rand.Int(rand.Reader, big.NewInt(MAX_PAIRING_NUMBER))
+	if err != nil {
+		return "", fmt.Errorf("On random number: %w", err)
+	}
+
+	code := []string{strconv.FormatInt(number.Int64()+1, 10)}
+	for range PAIRING_CODE_WORDS {
+		i, err := rand.Int(rand.Reader, big.NewInt(int64(len(pairing_words))))
+		if err != nil {
+			return "", fmt.Errorf("On random word: %w", err)
+		}
+		code = append(code, pairing_words[i.Int64()])
+	}
+	return strings.Join(code, "-"), nil
+}
+
+// ParsePairingCode normalizes a code typed in by the user.
+func ParsePairingCode(code string) (string, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	fields := strings.Split(code, "-")
+	if len(fields) != PAIRING_CODE_WORDS+1 {
+		return "", fmt.Errorf("%w: `%s`", ErrInvalidPairingCode, code)
+	}
+	_, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return "", fmt.Errorf("%w: `%s`", ErrInvalidPairingCode, code)
+	}
+	for _, word := range fields[1:] {
+		if word == "" {
+			return "", fmt.Errorf("%w: `%s`", ErrInvalidPairingCode, code)
+		}
+	}
+	return code, nil
+}
+
+// pairConn runs the key exchange for `code` over `conn`, the sender speaking
+// first, and returns `conn` encrypted with the session keys.
+func pairConn(conn net.Conn, code string, is_sender bool) (net.Conn, error) {
+	pake, err := newSpake2(code, is_sender)
+	if err != nil {
+		return nil, err
+	}
+
+	peer_message := make([]byte, pake_message_size)
+	if is_sender {
+		_, err = conn.Write(append([]byte(pairing_magic), pake.message...))
+		if err != nil {
+			return nil, fmt.Errorf("On write key share: %w", err)
+		}
+		_, err = io.ReadFull(conn, peer_message)
+		if err != nil {
+			return nil, fmt.Errorf("On read key share: %w", err)
+		}
+	} else {
+		magic := make([]byte, len(pairing_magic))
+		_, err = io.ReadFull(conn, magic)
+		if err != nil {
+			return nil, fmt.Errorf("On read pairing magic: %w", err)
+		}
+		if string(magic) != pairing_magic {
+			return nil, ErrNotPairing
+		}
+		_, err = io.ReadFull(conn, peer_message)
+		if err != nil {
+			return nil, fmt.Errorf("On read key share: %w", err)
+		}
+		_, err = conn.Write(pake.message)
+		if err != nil {
+			return nil, fmt.Errorf("On write key share: %w", err)
+		}
+	}
+
+	keys, err := pake.finish(peer_message)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both prove they got the same keys, the receiver only once the sender has
+	peer_confirmation := make([]byte, pake_confirm_size)
+	if is_sender {
+		_, err = conn.Write(keys.confirmation(true))
+		if err != nil {
+			return nil, fmt.Errorf("On write confirmation: %w", err)
+		}
+		_, err = io.ReadFull(conn, peer_confirmation)
+		if err != nil {
+			// The receiver hangs up on a wrong code
+			return nil, fmt.Errorf("%w: %w", ErrPakeConfirmation, err)
+		}
+		err = keys.checkConfirmation(false, peer_confirmation)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		_, err = io.ReadFull(conn, peer_confirmation)
+		if err != nil {
+			return nil, fmt.Errorf("On read confirmation: %w", err)
+		}
+		err = keys.checkConfirmation(true, peer_confirmation)
+		if err != nil {
+			return nil, err
+		}
+		_, err = conn.Write(keys.confirmation(false))
+		if err != nil {
+			return nil, fmt.Errorf("On write confirmation: %w", err)
+		}
+	}
+
+	send_key, recv_key := keys.sender_key, keys.receiver_key
+	if !is_sender {
+		send_key, recv_key = recv_key, send_key
+	}
+	send, err := newGCM(send_key)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newGCM(recv_key)
+	if err != nil {
+		return nil, err
+	}
+	return &pairedConn{Conn: conn, send: send, recv: recv}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("On cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("On GCM: %w", err)
+	}
+	return aead, nil
+}
+
+// pairedConn encrypts everything over the connection in records of up to
+// PAIRED_RECORD_SIZE bytes, each sent as its sealed length followed by the
+// sealed bytes. Every record has its own nonce, counting up from 0.
+type pairedConn struct {
+	net.Conn
+	send       cipher.AEAD
+	recv       cipher.AEAD
+	send_count uint64
+	recv_count uint64
+
+	sealed []byte
+	record []byte
+	plain  []byte
+}
+
+func recordNonce(aead cipher.AEAD, count uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], count)
+	return nonce
+}
+
+func (pc *pairedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), PAIRED_RECORD_SIZE)
+
+		header := make([]byte, paired_header_size)
+		binary.BigEndian.PutUint32(header, uint32(n+pc.send.Overhead()))
+		pc.sealed = append(pc.sealed[:0], header...)
+		pc.sealed = pc.send.Seal(pc.sealed, recordNonce(pc.send, pc.send_count), p[:n], header)
+		pc.send_count++
+
+		_, err := pc.Conn.Write(pc.sealed)
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the connection underneath, records are whole when it's called.
+func (pc *pairedConn) CloseWrite() error {
+	write_closer, ok := pc.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrNoHalfClose, pc.Conn)
+	}
+	return write_closer.CloseWrite()
+}
+
+func (pc *pairedConn) Read(p []byte) (int, error) {
+	if len(pc.plain) == 0 {
+		err := pc.readRecord()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, pc.plain)
+	pc.plain = pc.plain[n:]
+	return n, nil
+}
+
+func (pc *pairedConn) readRecord() error {
+	header := make([]byte, paired_header_size)
+	_, err := io.ReadFull(pc.Conn, header)
+	if err != nil {
+		return err
+	}
+	size := int(binary.BigEndian.Uint32(header))
+	if size <= pc.recv.Overhead() || size > PAIRED_RECORD_SIZE+pc.recv.Overhead() {
+		return fmt.Errorf("%w: %d bytes", ErrInvalidRecord, size)
+	}
+
+	if cap(pc.record) < size {
+		pc.record = make([]byte, size)
+	}
+	pc.record = pc.record[:size]
+	_, err = io.ReadFull(pc.Conn, pc.record)
+	if err != nil {
+		return fmt.Errorf("On read record: %w", err)
+	}
+
+	pc.plain, err = pc.recv.Open(pc.record[:0], recordNonce(pc.recv, pc.recv_count), pc.record, header)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidRecord, err)
+	}
+	pc.recv_count++
+	return nil
+}
+
+// pair runs the receiver's side of the key exchange on a new connection. A
+// host that gets the code wrong is backed off like one that fails to
+// authenticate, so guessing is slow without locking out everyone else.
+func (l *Listener) pair(conn *Conn) error {
+	addr := conn.remoteAddr()
+	host := conn.remoteHost()
+	if l.pairing_limiter.blocked(host) {
+		log.Warn("Refusing `%s`, too many failed pairings", addr)
+		return ErrAuthRateLimited
+	}
+	net_conn, ok := conn.c.(net.Conn)
+	if !ok {
+		return fmt.Errorf("%w: not a network connection", ErrNotPairing)
+	}
+
+	paired, err := pairConn(net_conn, l.PairingCode, false)
+	if errors.Is(err, ErrPakeConfirmation) {
+		count, backoff := l.pairing_limiter.failed(host)
+		log.Warn("Failed pairing from `%s` (%d in a row), refusing it for %s", addr, count, backoff)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	l.pairing_limiter.succeeded(host)
+	conn.c = paired
+	return nil
+}
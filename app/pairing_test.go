@@ -0,0 +1,43 @@
+package app
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestPairingBackoff gets the code wrong, which backs off the host and not
+// the code.
+func TestPairingBackoff(t *testing.T) {
+	l := newTestListener(t)
+	l.PairingCode = newTestPairingCode(t)
+	transport := serveMemory(t, l)
+	file_path := filepath.Join(t.TempDir(), "a.bin")
+	writeRandomFile(t, file_path, 1000, 1)
+
+	send := func(code string) error {
+		fs := NewTransportFileSender(transport, TEST_ADDRESS)
+		fs.PairingCode = code
+		defer fs.Close()
+		return fs.SendFiles([]string{file_path})
+	}
+
+	err := send(newTestPairingCode(t))
+	if !errors.Is(err, ErrPakeConfirmation) {
+		t.Fatalf("Wrong code: got %v, want %v", err, ErrPakeConfirmation)
+	}
+	err = send(l.PairingCode)
+	if err == nil {
+		t.Fatal("A backed off host paired")
+	}
+	if l.pairing_limiter.blocked("192.0.2.1") {
+		t.Fatal("Another host is backed off")
+	}
+
+	time.Sleep(AUTH_BACKOFF)
+	err = send(l.PairingCode)
+	if err != nil {
+		t.Fatalf("The code doesn't work after the backoff: %s", err)
+	}
+}
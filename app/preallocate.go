@@ -0,0 +1,11 @@
+//go:build !linux
+
+package app
+
+import (
+	"os"
+)
+
+func preallocate(file *os.File, size int64) error {
+	return preallocateTruncate(file, size)
+}
@@ -0,0 +1,25 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// preallocate reserves `size` bytes of disk for `file` so parts written with
+// WriteAt don't fragment it or run out of space midway.
+func preallocate(file *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return preallocateTruncate(file, size)
+	}
+	if err != nil {
+		return fmt.Errorf("On fallocate: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// allocatedSize is how much disk `file_path` takes, which is less than its size
+// when it has holes.
+func allocatedSize(t *testing.T, file_path string) int64 {
+	t.Helper()
+	var stat syscall.Stat_t
+	err := syscall.Stat(file_path, &stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stat.Blocks * 512
+}
+
+func TestPreallocate(t *testing.T) {
+	const size = 4 * MiB
+	file_path := filepath.Join(t.TempDir(), "a.bin")
+	file, err := os.Create(file_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	err = preallocate(file, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file_info, err := file.Stat()
+	if err != nil || file_info.Size() != size {
+		t.Fatalf("Size is %d, want %d: %v", file_info.Size(), size, err)
+	}
+	if allocated := allocatedSize(t, file_path); allocated < size {
+		t.Skipf("Only %d of %d bytes allocated, the filesystem can't fallocate", allocated, size)
+	}
+}
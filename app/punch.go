@@ -0,0 +1,521 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	log "github.com/NikosGour/logging/src"
+)
+
+const (
+	// How often a peer sends to the other while punching
+	PUNCH_INTERVAL = 200 * time.Millisecond
+	// How long peers punch before giving up on each other
+	PUNCH_TIMEOUT = 10 * time.Second
+	// How long a punched connection can go quiet, keep alives go out well before
+	PUNCH_IDLE_TIMEOUT = 30 * time.Second
+	PUNCH_KEEP_ALIVE   = 10 * time.Second
+	// How long the listener waits for the dialer to hang up before it does
+	PUNCH_CLOSE_TIMEOUT = 5 * time.Second
+	PUNCH_ALPN          = "bigdownloadp2p"
+	// The punched QUIC connection is only a carrier, TLS, pairing and the
+	// pre-shared key still run on top of it
+	PUNCH_CERTIFICATE_VALIDITY = 24 * time.Hour
+)
+
+const (
+	// punch_magic is what peers send each other to open their NATs, it is
+	// never a QUIC packet so QUIC leaves it to us
+	punch_magic = "\x00BDP-PUNCH"
+	// stream_magic starts every stream, the listener only sees a stream once
+	// the dialer writes to it
+	stream_magic = "BDP-STREAM"
+)
+
+var ErrPunchFailed = errors.New("Couldn't punch a path to the peer")
+
+// PunchTransport reaches peers behind NATs. Both ends register with the
+// rendezvous at `Rendezvous` under the same name, learn the public endpoint of
+// the other and send to it until their NATs let the other in. The transfer then
+// runs over QUIC on that UDP path. Addresses are the names peers register as.
+type PunchTransport struct {
+	Rendezvous string
+	// SimulateNAT maps the socket to another port and drops what comes from
+	// endpoints that weren't sent to first, so punching can be tried on one machine
+	SimulateNAT bool
+}
+
+func (pt PunchTransport) Dial(name string) (net.Conn, error) {
+	rc, err := pt.open(name, ROLE_DIALER)
+	if err != nil {
+		return nil, err
+	}
+	message, err := rc.ask(RENDEZVOUS_PEER)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	peer, err := net.ResolveUDPAddr("udp", message.Peer)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("%w: `%s`", ErrInvalidRendezvous, message.Peer)
+	}
+	log.Debug("Punching from `%s` to `%s`", message.Endpoint, peer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), PUNCH_TIMEOUT)
+	defer cancel()
+	go rc.punch(ctx, peer)
+
+	tls_config := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{PUNCH_ALPN}}
+	quic_conn, err := rc.transport.Dial(ctx, peer, tls_config, punchConfig())
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("%w `%s`: %w", ErrPunchFailed, peer, err)
+	}
+	stream, err := quic_conn.OpenStreamSync(ctx)
+	if err != nil {
+		quic_conn.CloseWithError(0, "")
+		rc.Close()
+		return nil, fmt.Errorf("On open stream: %w", err)
+	}
+	_, err = stream.Write([]byte(stream_magic))
+	if err != nil {
+		quic_conn.CloseWithError(0, "")
+		rc.Close()
+		return nil, fmt.Errorf("On write stream magic: %w", err)
+	}
+	return &quicConn{Stream: stream, conn: quic_conn, owner: rc}, nil
+}
+
+func (pt PunchTransport) Listen(name string) (net.Listener, error) {
+	rc, err := pt.open(name, ROLE_LISTENER)
+	if err != nil {
+		return nil, err
+	}
+	cert_der, key, err := newCertificate(PUNCH_CERTIFICATE_VALIDITY)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	tls_config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert_der}, PrivateKey: key}},
+		NextProtos:   []string{PUNCH_ALPN},
+	}
+	quic_listener, err := rc.transport.Listen(tls_config, punchConfig())
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("On listen: %w", err)
+	}
+
+	message, err := rc.ask(RENDEZVOUS_REGISTERED)
+	if err != nil {
+		quic_listener.Close()
+		rc.Close()
+		return nil, err
+	}
+	log.Info("Registered as `%s` at `%s`, public endpoint `%s`", name, rc.server, message.Endpoint)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pl := &punchListener{rc: rc, listener: quic_listener, name: name, conns: make(chan net.Conn), ctx: ctx, cancel: cancel}
+	go pl.keepRegistered()
+	go pl.acceptLoop()
+	return pl, nil
+}
+
+func punchConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout:   PUNCH_TIMEOUT,
+		MaxIdleTimeout:         PUNCH_IDLE_TIMEOUT,
+		KeepAlivePeriod:        PUNCH_KEEP_ALIVE,
+		MaxStreamReceiveWindow: uint64(MUX_STREAM_WINDOW),
+	}
+}
+
+// rendezvousClient is the UDP socket of a peer, QUIC and the rendezvous
+// messages share it so the rendezvous sees the endpoint the peer punches from.
+type rendezvousClient struct {
+	socket    net.PacketConn
+	transport *quic.Transport
+	server    *net.UDPAddr
+	name      string
+	role      string
+	messages  chan RendezvousJSON
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+func (pt PunchTransport) open(name string, role string) (*rendezvousClient, error) {
+	server, err := net.ResolveUDPAddr("udp", pt.Rendezvous)
+	if err != nil {
+		return nil, fmt.Errorf("On resolve rendezvous: %w", err)
+	}
+	udp_conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("On listen udp: %w", err)
+	}
+	var socket net.PacketConn = udp_conn
+	if pt.SimulateNAT {
+		socket, err = newSimulatedNAT(udp_conn)
+		if err != nil {
+			udp_conn.Close()
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := &rendezvousClient{
+		socket:    socket,
+		transport: &quic.Transport{Conn: socket},
+		server:    server,
+		name:      name,
+		role:      role,
+		messages:  make(chan RendezvousJSON, 16),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	// QUIC drops what isn't QUIC until the first read, this one returns at once
+	done, stop := context.WithCancel(ctx)
+	stop()
+	_, _, _ = rc.transport.ReadNonQUICPacket(done, nil)
+	go rc.read()
+	return rc, nil
+}
+
+// read passes the messages of the rendezvous on, punches only have to arrive.
+func (rc *rendezvousClient) read() {
+	packet := make([]byte, MAX_RENDEZVOUS_SIZE)
+	for {
+		n, addr, err := rc.transport.ReadNonQUICPacket(rc.ctx, packet)
+		if err != nil {
+			return
+		}
+		message, ok := decodeRendezvous(packet[:n])
+		if !ok || !sameEndpoint(addr, rc.server) {
+			continue
+		}
+		select {
+		case rc.messages <- message:
+		default:
+			log.Debug("Dropping a rendezvous message, too many pending")
+		}
+	}
+}
+
+func (rc *rendezvousClient) register() error {
+	message := RendezvousJSON{Type: RENDEZVOUS_REGISTER, Name: rc.name, Role: rc.role, Local: rc.socket.LocalAddr().String()}
+	err := writeRendezvous(rc.transport, message, rc.server)
+	if err != nil {
+		return fmt.Errorf("On register: %w", err)
+	}
+	return nil
+}
+
+// ask registers until the rendezvous answers with a message of type `want`.
+func (rc *rendezvousClient) ask(want string) (RendezvousJSON, error) {
+	retry := time.NewTicker(RENDEZVOUS_RETRY)
+	defer retry.Stop()
+	timeout := time.After(RENDEZVOUS_TIMEOUT)
+
+	err := rc.register()
+	if err != nil {
+		return RendezvousJSON{}, err
+	}
+	for {
+		select {
+		case message := <-rc.messages:
+			err := message.err()
+			if err != nil {
+				return RendezvousJSON{}, err
+			}
+			if message.Type == want {
+				return message, nil
+			}
+		case <-retry.C:
+			err := rc.register()
+			if err != nil {
+				return RendezvousJSON{}, err
+			}
+		case <-timeout:
+			return RendezvousJSON{}, fmt.Errorf("%w: `%s`", ErrRendezvousTimeout, rc.server)
+		}
+	}
+}
+
+// punch sends to `peer` until `ctx` is done, so our NAT lets the peer in and
+// the peer's NAT takes ours as an answer.
+func (rc *rendezvousClient) punch(ctx context.Context, peer net.Addr) {
+	ticker := time.NewTicker(PUNCH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		_, err := rc.transport.WriteTo([]byte(punch_magic), peer)
+		if err != nil {
+			log.Debug("Couldn't punch `%s`: %s", peer, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (rc *rendezvousClient) Close() error {
+	rc.cancel()
+	rc.transport.Close()
+	return rc.socket.Close()
+}
+
+func sameEndpoint(a net.Addr, b *net.UDPAddr) bool {
+	udp_addr, ok := a.(*net.UDPAddr)
+	return ok && udp_addr.IP.Equal(b.IP) && udp_addr.Port == b.Port
+}
+
+// punchListener accepts the streams of the peers the rendezvous introduces.
+type punchListener struct {
+	rc       *rendezvousClient
+	listener *quic.Listener
+	name     string
+	conns    chan net.Conn
+	ctx      context.Context
+	cancel   context.CancelFunc
+	close    sync.Once
+}
+
+// keepRegistered registers again before the rendezvous forgets us and punches
+// to every peer it introduces.
+func (pl *punchListener) keepRegistered() {
+	ticker := time.NewTicker(RENDEZVOUS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pl.ctx.Done():
+			return
+		case <-ticker.C:
+			err := pl.rc.register()
+			if err != nil {
+				log.Warn("%s", err)
+			}
+		case message := <-pl.rc.messages:
+			err := message.err()
+			if err != nil {
+				log.Warn("%s", err)
+				continue
+			}
+			if message.Type != RENDEZVOUS_PEER {
+				continue
+			}
+			peer, err := net.ResolveUDPAddr("udp", message.Peer)
+			if err != nil {
+				log.Warn("%s", fmt.Errorf("%w: `%s`", ErrInvalidRendezvous, message.Peer))
+				continue
+			}
+			log.Debug("Punching to `%s`", peer)
+			go func() {
+				ctx, cancel := context.WithTimeout(pl.ctx, PUNCH_TIMEOUT)
+				defer cancel()
+				pl.rc.punch(ctx, peer)
+			}()
+		}
+	}
+}
+
+func (pl *punchListener) acceptLoop() {
+	for {
+		quic_conn, err := pl.listener.Accept(pl.ctx)
+		if err != nil {
+			if pl.ctx.Err() == nil {
+				log.Error("%s", fmt.Errorf("On accept quic: %w", err))
+				pl.Close()
+			}
+			return
+		}
+		go func() {
+			conn, err := acceptStream(quic_conn)
+			if err != nil {
+				log.Warn("Dropping `%s`: %s", quic_conn.RemoteAddr(), err)
+				quic_conn.CloseWithError(0, "")
+				return
+			}
+			select {
+			case pl.conns <- conn:
+			case <-pl.ctx.Done():
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func acceptStream(quic_conn *quic.Conn) (*quicConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), PUNCH_TIMEOUT)
+	defer cancel()
+	stream, err := quic_conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("On accept stream: %w", err)
+	}
+
+	_ = stream.SetReadDeadline(time.Now().Add(PUNCH_TIMEOUT))
+	magic := make([]byte, len(stream_magic))
+	_, err = io.ReadFull(stream, magic)
+	if err != nil {
+		return nil, fmt.Errorf("On read stream magic: %w", err)
+	}
+	if string(magic) != stream_magic {
+		return nil, ErrIncompatiblePeer
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+	return &quicConn{Stream: stream, conn: quic_conn, linger: true}, nil
+}
+
+func (pl *punchListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case <-pl.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (pl *punchListener) Close() error {
+	pl.close.Do(func() {
+		pl.cancel()
+		message := RendezvousJSON{Type: RENDEZVOUS_UNREGISTER, Name: pl.name, Role: ROLE_LISTENER}
+		_ = writeRendezvous(pl.rc.transport, message, pl.rc.server)
+		pl.listener.Close()
+		pl.rc.Close()
+	})
+	return nil
+}
+
+func (pl *punchListener) Addr() net.Addr {
+	return punchAddr(pl.name)
+}
+
+type punchAddr string
+
+func (pa punchAddr) Network() string {
+	return "punch"
+}
+
+func (pa punchAddr) String() string {
+	return string(pa)
+}
+
+// quicConn is a stream of a punched QUIC connection, the only one it carries.
+type quicConn struct {
+	*quic.Stream
+	conn *quic.Conn
+	// owner is closed with the connection, the socket of a dialer
+	owner io.Closer
+	// linger waits for the peer to hang up first, closing the connection drops
+	// what the peer hasn't received yet
+	linger bool
+	close  sync.Once
+}
+
+func (qc *quicConn) LocalAddr() net.Addr {
+	return qc.conn.LocalAddr()
+}
+
+func (qc *quicConn) RemoteAddr() net.Addr {
+	return qc.conn.RemoteAddr()
+}
+
+// Read ends with io.EOF when the peer hung up cleanly, like over TCP.
+func (qc *quicConn) Read(p []byte) (int, error) {
+	n, err := qc.Stream.Read(p)
+	var app_err *quic.ApplicationError
+	if errors.As(err, &app_err) && app_err.Remote && app_err.ErrorCode == 0 {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (qc *quicConn) CloseWrite() error {
+	return qc.Stream.Close()
+}
+
+func (qc *quicConn) Close() error {
+	qc.close.Do(func() {
+		qc.Stream.Close()
+		if qc.linger {
+			select {
+			case <-qc.conn.Context().Done():
+			case <-time.After(PUNCH_CLOSE_TIMEOUT):
+			}
+		}
+		qc.conn.CloseWithError(0, "")
+		if qc.owner != nil {
+			qc.owner.Close()
+		}
+	})
+	return nil
+}
+
+// simulatedNAT maps the socket of a peer to an external port of its own, the
+// one the rendezvous and the other peer see, and lets in only what comes from
+// endpoints that were sent to first, like a port restricted cone NAT.
+type simulatedNAT struct {
+	// PacketConn is the external port, everything goes out and in through it
+	net.PacketConn
+	// internal is the peer's own socket, only where the peer thinks it is
+	internal  net.PacketConn
+	contacted map[string]bool
+	mu        sync.Mutex
+}
+
+func newSimulatedNAT(internal net.PacketConn) (*simulatedNAT, error) {
+	local, ok := internal.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("On simulate NAT: %T isn't a UDP socket", internal)
+	}
+	external, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		return nil, fmt.Errorf("On simulate NAT: %w", err)
+	}
+	return &simulatedNAT{PacketConn: external, internal: internal, contacted: map[string]bool{}}, nil
+}
+
+func (sn *simulatedNAT) LocalAddr() net.Addr {
+	return sn.internal.LocalAddr()
+}
+
+// mapped is the endpoint the NAT maps the peer's socket to.
+func (sn *simulatedNAT) mapped() net.Addr {
+	return sn.PacketConn.LocalAddr()
+}
+
+func (sn *simulatedNAT) WriteTo(p []byte, addr net.Addr) (int, error) {
+	sn.mu.Lock()
+	sn.contacted[addr.String()] = true
+	sn.mu.Unlock()
+	return sn.PacketConn.WriteTo(p, addr)
+}
+
+func (sn *simulatedNAT) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := sn.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		sn.mu.Lock()
+		contacted := sn.contacted[addr.String()]
+		sn.mu.Unlock()
+		if contacted {
+			return n, addr, nil
+		}
+		log.Debug("NAT dropped a packet from `%s`", addr)
+	}
+}
+
+func (sn *simulatedNAT) Close() error {
+	sn.internal.Close()
+	return sn.PacketConn.Close()
+}
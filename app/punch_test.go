@@ -0,0 +1,153 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serveRendezvous runs a rendezvous on loopback until the test ends, and
+// returns its address.
+func serveRendezvous(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- NewRendezvousServer().Serve(conn) }()
+	t.Cleanup(func() {
+		conn.Close()
+		err := <-done
+		if err != nil {
+			t.Errorf("Rendezvous: %s", err)
+		}
+	})
+	return conn.LocalAddr().String()
+}
+
+func TestPunchedTransfer(t *testing.T) {
+	transport := PunchTransport{Rendezvous: serveRendezvous(t), SimulateNAT: true}
+	file_path := filepath.Join(t.TempDir(), "a.bin")
+	writeRandomFile(t, file_path, 2*int(MiB)+3, 5)
+
+	tests := []struct {
+		name      string
+		multiplex bool
+	}{
+		{"plain", false},
+		{"multiplexed", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newTestListener(t)
+			serve(t, l, transport, "punched-"+test.name)
+
+			fs := NewTransportFileSender(transport, "punched-"+test.name)
+			fs.Multiplex = test.multiplex
+			fs.Parts = 2
+			defer fs.Close()
+			err := fs.SendFiles([]string{file_path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSameFile(t, file_path, filepath.Join(l.DownloadsDir, "a.bin"))
+		})
+	}
+
+	// The punch reaches the listener at the port its NAT mapped it to, not the
+	// one its socket has
+	t.Run("through the mapped endpoint", func(t *testing.T) {
+		ln, err := transport.Listen("punched-mapped")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		nat := ln.(*punchListener).rc.socket.(*simulatedNAT)
+		go func() {
+			conn, err := ln.Accept()
+			if err == nil {
+				conn.Close()
+			}
+		}()
+
+		conn, err := transport.Dial("punched-mapped")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		remote := conn.RemoteAddr().(*net.UDPAddr)
+		mapped := nat.mapped().(*net.UDPAddr)
+		local := nat.LocalAddr().(*net.UDPAddr)
+		if remote.Port != mapped.Port || remote.Port == local.Port {
+			t.Fatalf("Punched to `%s`, want the mapped `%s` and not `%s`", remote, mapped, local)
+		}
+	})
+
+	t.Run("no listener", func(t *testing.T) {
+		_, err := transport.Dial("nobody")
+		if !errors.Is(err, ErrNoListener) {
+			t.Fatalf("Got %v, want %v", err, ErrNoListener)
+		}
+	})
+}
+
+// TestSimulatedNAT sends from a mapped port and lets in only the endpoints
+// that were sent to.
+func TestSimulatedNAT(t *testing.T) {
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	nat, err := newSimulatedNAT(listen())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nat.Close()
+	outside := listen()
+
+	receive := func() error {
+		nat.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		packet := make([]byte, 16)
+		_, _, err := nat.ReadFrom(packet)
+		return err
+	}
+
+	_, err = outside.WriteTo([]byte("in"), nat.mapped())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = receive()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Got %v from an endpoint that wasn't sent to", err)
+	}
+
+	_, err = nat.WriteTo([]byte("out"), outside.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside.SetReadDeadline(time.Now().Add(time.Second))
+	_, from, err := outside.ReadFrom(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.String() != nat.mapped().String() || from.String() == nat.LocalAddr().String() {
+		t.Fatalf("Sent from `%s`, want the mapped `%s` and not `%s`", from, nat.mapped(), nat.LocalAddr())
+	}
+
+	_, err = outside.WriteTo([]byte("in"), from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = receive()
+	if err != nil {
+		t.Fatalf("Dropped a packet from an endpoint that was sent to: %s", err)
+	}
+}
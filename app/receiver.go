@@ -3,15 +3,16 @@ package app
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 
 	log "github.com/NikosGour/logging/src"
@@ -20,14 +21,31 @@ import (
 
 var (
 	ErrUnrecognizedRequestType = errors.New("Unrecognized request type")
+	ErrUnknownFileDownload     = errors.New("Unknown file download")
+	ErrInvalidPartNumber       = errors.New("Invalid part number")
+	ErrInvalidNumberOfParts    = errors.New("Invalid number of parts")
+	ErrInvalidFileRange        = errors.New("Invalid part range")
+	ErrPartLengthMismatch      = errors.New("Part length doesn't match the received bytes")
 )
 
 type Conn struct {
 	c io.ReadWriteCloser
+
+	// What both sides agreed on in the handshake
+	version      int
+	capabilities []Capability
+
+	// json_frames sends every message as JSON, for debugging
+	json_frames bool
+	// carrier is the connection a multiplexed stream is on
+	carrier *Conn
+	// tls_conn is the TLS connection under `c`, which pairing wraps
+	tls_conn *tls.Conn
 }
 
 func NewConn(conn io.ReadWriteCloser) *Conn {
 	c := &Conn{c: conn}
+	c.tls_conn, _ = conn.(*tls.Conn)
 	return c
 }
 
@@ -35,6 +53,15 @@ func (conn *Conn) Close() error {
 	return conn.c.Close()
 }
 
+// setDeadline bounds every read and write on the connection, if it can be.
+func (conn *Conn) setDeadline(deadline time.Time) error {
+	deadline_conn, ok := conn.c.(interface{ SetDeadline(time.Time) error })
+	if !ok {
+		return nil
+	}
+	return deadline_conn.SetDeadline(deadline)
+}
+
 func (conn *Conn) Read(p []byte) (n int, err error) {
 	return conn.c.Read(p)
 }
@@ -44,43 +71,49 @@ func (conn *Conn) Write(p []byte) (n int, err error) {
 }
 
 type Listener struct {
-	Port                int
-	DownloadsDir        string
-	activeFileDownloads cmap.ConcurrentMap[UUID, *ActiveFileDownload]
-}
+	Port int
+	// Address is where to listen, empty listens on every interface on Port
+	Address string
+	// Transport is what to listen on, nil listens over TCP
+	Transport    Transport
+	DownloadsDir string
+	// PreserveMetadata applies the sender's permissions and mod times to the downloads
+	PreserveMetadata bool
+	// Compressions are the part body compressions accepted from senders
+	Compressions []Compression
+	// Identity turns on TLS, senders see it as the Listener's fingerprint
+	Identity *Identity
+	// PairingCode makes every sender prove it knows the code, the connection is
+	// then encrypted with keys derived from it
+	PairingCode string
+	// PreSharedKey makes every sender answer a challenge with it before any request
+	PreSharedKey []byte
+	// JSONFrames sends every message as JSON instead of binary, for debugging
+	JSONFrames bool
+	// AllowedPeers are the hosts and fingerprints offers are accepted from, empty allows any
+	AllowedPeers []string
+	// MaxSize declines the offers bigger than it, 0 has no limit
+	MaxSize int64
+	// AutoAccept accepts the offers the policy allows without asking `Prompt`
+	AutoAccept bool
+	// Prompt is asked about every other offer, nil accepts them
+	Prompt func(offer OfferJSON) bool
+	// SessionComplete is called with the outcome of every session
+	SessionComplete func(result SessionResultJSON)
+
+	pairing_limiter authLimiter
+	auth_limiter    authLimiter
+	sessions        cmap.ConcurrentMap[UUID, *session]
+	prompt_mu       sync.Mutex
 
-type ActiveFileDownload struct {
-	FileNames     []string
-	DirName       string
-	FileParts     int
-	PartsFinished int
-	DoneChan      chan int
-	Done          bool
-}
-
-func NewActiveFileDownload(file_parts int) *ActiveFileDownload {
-	afd := &ActiveFileDownload{FileParts: file_parts, Done: false}
-	afd.FileNames = []string{}
-	afd.DoneChan = make(chan int)
-	go func() {
-		for {
-			if afd.FileParts <= afd.PartsFinished {
-				afd.Done = true
-				close(afd.DoneChan)
-				return
-			}
-			<-afd.DoneChan
-			afd.PartsFinished++
-		}
-	}()
-
-	return afd
+	activeFileDownloads cmap.ConcurrentMap[UUID, *ActiveFileDownload]
 }
 
 func NewListener(port int, downloads_dir string) *Listener {
-	l := &Listener{Port: port}
+	l := &Listener{Port: port, PreserveMetadata: true, Compressions: SUPPORTED_COMPRESSIONS}
 	l.DownloadsDir = path.Join(PROJECT_DIR, "downloads")
 	l.activeFileDownloads = cmap.NewStringer[UUID, *ActiveFileDownload]()
+	l.sessions = cmap.NewStringer[UUID, *session]()
 
 	if downloads_dir != "" {
 		l.DownloadsDir = downloads_dir
@@ -90,48 +123,178 @@ func NewListener(port int, downloads_dir string) *Listener {
 }
 
 func (l *Listener) Listen() error {
+	address := l.Address
+	if address == "" {
+		address = "0.0.0.0:" + strconv.Itoa(l.Port)
+	}
+	transport := l.Transport
+	if transport == nil {
+		transport = TCPTransport{}
+	}
 
-	address := "0.0.0.0:" + strconv.Itoa(l.Port)
-	ln, err := net.Listen("tcp", address)
+	ln, err := transport.Listen(address)
 	if err != nil {
 		return fmt.Errorf("On listen: %w", err)
 	}
-	log.Info("Listening on `%s`", address)
-	go l.handleActiveFileDownloads()
+	return l.Serve(ln)
+}
+
+// Serve handles every connection `ln` accepts, until it is closed. The
+// downloads dir is made here once, connections only read it.
+func (l *Listener) Serve(ln net.Listener) error {
+	// Create downloads dir if it doesn't exist
+	downloads_dir, err := tryMakeNewDir(l.DownloadsDir)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	l.DownloadsDir = downloads_dir
+
+	if l.Identity != nil {
+		log.Info("TLS fingerprint: %s", l.Identity.Fingerprint)
+	}
+	log.Info("Listening on `%s`", ln.Addr())
 
 	for {
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
 			return fmt.Errorf("On accept: %w", err)
 		}
 
-		go l.handleConnection(NewConn(conn))
+		c := NewConn(conn)
+		c.json_frames = l.JSONFrames
+		go l.handleConnection(c)
 	}
 }
 
-func (l *Listener) handleActiveFileDownloads() {
-	for {
-		if l.activeFileDownloads.Count() != 0 {
-			for tuple := range l.activeFileDownloads.IterBuffered() {
-				active_file := tuple.Val
-				if active_file.Done {
-					l.FinalizeFileDownload(active_file.DirName)
-				}
-			}
-		}
+// FinalizeFileDownload checks that the received parts cover the whole file and
+// moves the preallocated download into place.
+// It returns the path of the downloaded file.
+func (l *Listener) FinalizeFileDownload(uuid UUID) (string, error) {
+	active_file, ok := l.activeFileDownloads.Pop(uuid)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownFileDownload, uuid)
 	}
+
+	file_name, err := active_file.finalize(l.DownloadsDir, l.PreserveMetadata)
+	if err != nil {
+		active_file.remove()
+	}
+	return file_name, err
 }
-func (l *Listener) FinalizeFileDownload(path string) {
 
+// getActiveFileDownload returns the download for `uuid`, picking up the state a
+// previous run left on disk if it isn't in memory.
+func (l *Listener) getActiveFileDownload(uuid UUID, file_info FileInfoJSON) (*ActiveFileDownload, error) {
+	var load_err error
+	active_file := l.activeFileDownloads.Upsert(uuid, nil,
+		func(exist bool, in_map *ActiveFileDownload, _ *ActiveFileDownload) *ActiveFileDownload {
+			if exist {
+				return in_map
+			}
+
+			temp_name := downloadTempName(l.DownloadsDir, file_info.Name, uuid)
+			afd, err := loadActiveFileDownload(temp_name)
+			if err != nil {
+				load_err = err
+				return nil
+			}
+			if afd != nil {
+				log.Info("Resuming download of `%s`", afd.FileName)
+				return afd
+			}
+			return NewActiveFileDownload(temp_name, file_info)
+		})
+	if load_err != nil {
+		l.activeFileDownloads.Remove(uuid)
+		return nil, load_err
+	}
+
+	err := active_file.matches(file_info)
+	if err != nil {
+		return nil, err
+	}
+	return active_file, nil
 }
 
 func (l *Listener) handleConnection(conn *Conn) {
 	defer conn.Close()
+
+	// A peer that goes quiet before the hello would hold the connection forever
+	err := conn.setDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	if err != nil {
+		log.Error("%s", fmt.Errorf("On deadline: %w", err))
+		return
+	}
+
+	own := l.hello()
+	err = conn.acceptHello(own)
+	if err != nil {
+		log.Error("%s", fmt.Errorf("On hello from `%s`: %w", conn.remoteAddr(), err))
+		return
+	}
+
+	if l.Identity != nil {
+		err := conn.serveTLS(l.Identity)
+		if err != nil {
+			log.Error("%s", fmt.Errorf("On TLS from `%s`: %w", conn.remoteAddr(), err))
+			return
+		}
+	}
+	if l.PairingCode != "" {
+		err := l.pair(conn)
+		if err != nil {
+			log.Error("%s", fmt.Errorf("On pairing: %w", err))
+			return
+		}
+	}
+	if len(l.PreSharedKey) > 0 {
+		err := l.authenticate(conn)
+		if err != nil {
+			log.Error("%s", fmt.Errorf("On authentication from `%s`: %w", conn.remoteAddr(), err))
+			return
+		}
+	}
+
+	fingerprint := conn.peerFingerprint()
+	if fingerprint != "" {
+		log.Debug("peer_fingerprint=%s", fingerprint)
+	}
+
+	if conn.secured() {
+		err = conn.acceptConfirmHello(own)
+		if err != nil {
+			log.Error("%s", fmt.Errorf("On hello from `%s`: %w", conn.remoteAddr(), err))
+			return
+		}
+	}
+	err = conn.setDeadline(time.Time{})
+	if err != nil {
+		log.Error("%s", fmt.Errorf("On deadline: %w", err))
+		return
+	}
+	log.Debug("version=%d, capabilities=%v", conn.version, conn.capabilities)
+
+	if conn.hasCapability(CapabilityMultiplex) {
+		l.serveMultiplexed(conn)
+		return
+	}
+	l.handleRequest(conn)
+}
+
+// handleRequest receives a request and replies with how it turned out.
+func (l *Listener) handleRequest(conn *Conn) {
 	timer := time.Now()
 
-	request_header, err := conn.receiveRequestHeader()
+	request_header, err := receiveMessage[RequestHeader](conn)
 	if err != nil {
 		log.Error("%s", err)
+		if errors.Is(err, ErrInvalidFrame) {
+			conn.sendStatus(err)
+		}
 		return
 	}
 
@@ -141,36 +304,47 @@ func (l *Listener) handleConnection(conn *Conn) {
 	case RequestSendString:
 		err = conn.receiveString()
 		if err != nil {
-			log.Error("%s", fmt.Errorf("On receive string: %w", err))
+			err = fmt.Errorf("On receive string: %w", err)
 		}
 	case RequestSendFile:
 		err = conn.receiveFile(l, request_header)
 		if err != nil {
-			log.Error("%s", fmt.Errorf("On receive file: %w", err))
+			err = fmt.Errorf("On receive file: %w", err)
 		}
-	default:
-		err = ErrUnrecognizedRequestType
+	case RequestResumeQuery:
+		err = conn.replyResumeState(l, request_header)
 		if err != nil {
-			log.Error("%s", fmt.Errorf("%w: %d", err, request_header.RequestType))
+			err = fmt.Errorf("On resume query: %w", err)
 		}
+	case RequestMakeDir:
+		err = conn.receiveDir(l, request_header)
+		if err != nil {
+			err = fmt.Errorf("On receive dir: %w", err)
+		}
+	case RequestMakeSymlink:
+		err = conn.receiveSymlink(l, request_header)
+		if err != nil {
+			err = fmt.Errorf("On receive symlink: %w", err)
+		}
+	case RequestOffer:
+		err = conn.replyOffer(l)
+		if err != nil {
+			err = fmt.Errorf("On offer: %w", err)
+		}
+	case RequestEndSession:
+		err = conn.replyEndSession(l, request_header)
+		if err != nil {
+			err = fmt.Errorf("On end session: %w", err)
+		}
+	default:
+		err = fmt.Errorf("%w: %d", ErrUnrecognizedRequestType, request_header.RequestType)
 	}
-
-	log.Info("Download took %s", time.Since(timer))
-}
-
-func (conn *Conn) receiveRequestHeader() (RequestHeader, error) {
-	json_request_header, err := conn.receiveSmallBytes()
-	if err != nil {
-		return RequestHeader{}, err
-	}
-
-	var request_header RequestHeader
-	err = json.Unmarshal(json_request_header.Bytes(), &request_header)
 	if err != nil {
-		return RequestHeader{}, fmt.Errorf("On Unmarshal json: %w", err)
+		log.Error("%s", err)
 	}
+	conn.sendStatus(err)
 
-	return request_header, nil
+	log.Info("Download took %s", time.Since(timer))
 }
 
 func (conn *Conn) receiveString() error {
@@ -197,132 +371,408 @@ func (conn *Conn) readBytes() (bytes.Buffer, error) {
 	return data, nil
 }
 
-func (conn *Conn) receiveSmallBytes() (bytes.Buffer, error) {
-	var size int64
-	err := binary.Read(conn, binary.BigEndian, &size)
+func (conn *Conn) receiveFile(l *Listener, request_header RequestHeader) error {
+	// Get the file info
+	file_info, err := receiveMessage[FileInfoJSON](conn)
+	if err != nil {
+		return err
+	}
+	log.Debug("file_info=%#v", file_info)
+
+	err = validateFileInfo(file_info)
+	if err != nil {
+		return err
+	}
+	err = validatePartInfo(file_info)
+	if err != nil {
+		return err
+	}
+	sess, err := l.checkOffered(conn, request_header, file_info)
 	if err != nil {
-		return bytes.Buffer{}, fmt.Errorf("On read size:%w", err)
+		return err
+	}
+	sess.start()
+	defer sess.stop()
+	if !file_info.Compression.isNone() && !conn.hasCapability(compressionCapability(file_info.Compression)) {
+		return fmt.Errorf("%w: `%s`", ErrUnsupportedCompression, file_info.Compression)
 	}
 
-	data := bytes.Buffer{}
-	n, err := io.CopyN(&data, conn, size)
+	active_file, err := l.getActiveFileDownload(request_header.UUID, file_info)
+	if err != nil {
+		return err
+	}
+
+	file, err := active_file.startPart(file_info.PartNumber, file_info.Resume)
 	if err != nil {
-		return bytes.Buffer{}, fmt.Errorf("On read object: %w", err)
+		return err
 	}
 
-	if n <= 0 {
-		log.Warn("Read `%d` bytes for object", n)
+	err = conn.receiveFilePart(file, file_info, func(written int64) error {
+		return active_file.checkpoint(file_info.PartNumber, written)
+	}, func(n int) {
+		sess.progress(file_info.relPath(), n)
+	})
+
+	part_range := FileRange{Offset: file_info.Offset, Length: file_info.Length}
+	if active_file.finishPart(file_info.PartNumber, part_range, file_info.PartHashes[file_info.PartNumber], err) {
+		final_name, err := l.FinalizeFileDownload(request_header.UUID)
+		if err != nil {
+			log.Error("%s", fmt.Errorf("On finalize `%s`: %w", file_info.Name, err))
+		} else {
+			log.Info("Finished downloading `%s`", final_name)
+		}
+		sess.fileDone(file_info.relPath(), final_name, err)
+	} else if err != nil {
+		sess.fileDone(file_info.relPath(), "", err)
 	}
-	return data, nil
+
+	return err
+}
+
+// replyResumeState tells the sender how much of every part is already on disk.
+func (conn *Conn) replyResumeState(l *Listener, request_header RequestHeader) error {
+	file_info, err := receiveMessage[FileInfoJSON](conn)
+	if err != nil {
+		return err
+	}
+	err = validateFileInfo(file_info)
+	if err != nil {
+		return err
+	}
+	_, err = l.checkOffered(conn, request_header, file_info)
+	if err != nil {
+		return err
+	}
+
+	active_file, err := l.getActiveFileDownload(request_header.UUID, file_info)
+	if err != nil {
+		return err
+	}
+
+	state := active_file.resumeState()
+	log.Debug("resume_state=%#v", state)
+	_, err = conn.sendMessage(state)
+	return err
 }
 
-func receiveJson[T any](conn *Conn) (T, error) {
-	var rv T
-	data, err := conn.receiveSmallBytes()
+// receiveDir creates a directory of a tree being sent. It is sent after its
+// contents so the metadata applied here sticks.
+func (conn *Conn) receiveDir(l *Listener, request_header RequestHeader) error {
+	dir_info, err := receiveMessage[FileInfoJSON](conn)
 	if err != nil {
-		return rv, err
+		return err
 	}
+	log.Debug("dir_info=%#v", dir_info)
 
-	err = json.Unmarshal(data.Bytes(), &rv)
+	err = validateFilePath(dir_info)
+	if err != nil {
+		return err
+	}
+	sess, err := l.checkOffered(conn, request_header, dir_info)
 	if err != nil {
-		return rv, fmt.Errorf("On unmarshal: %w", err)
+		return err
 	}
 
-	return rv, nil
+	dir_name, err := makeDir(l.DownloadsDir, dir_info, l.PreserveMetadata)
+	sess.fileDone(dir_info.relPath(), dir_name, err)
+	if err != nil {
+		return err
+	}
+	log.Info("Created directory `%s`", dir_name)
+	return nil
 }
 
-func (conn *Conn) receiveFile(l *Listener, request_header RequestHeader) error {
-	// Create downloads dir if it doesn't exist
-	downloads_dir, err := tryMakeNewDir(l.DownloadsDir)
+func makeDir(root string, dir_info FileInfoJSON, preserve_metadata bool) (string, error) {
+	dir_name, err := confinedDir(root, dir_info.relPath())
+	if err != nil {
+		return "", err
+	}
+	if preserve_metadata {
+		return dir_name, applyMetadata(dir_name, dir_info.Mode, dir_info.ModTime)
+	}
+	return dir_name, nil
+}
+
+// receiveSymlink recreates a link of a tree being sent, as long as it points
+// inside the downloads dir.
+func (conn *Conn) receiveSymlink(l *Listener, request_header RequestHeader) error {
+	link_info, err := receiveMessage[FileInfoJSON](conn)
 	if err != nil {
 		return err
 	}
-	l.DownloadsDir = downloads_dir
+	log.Debug("link_info=%#v", link_info)
 
-	// Get the file info
-	file_info, err := receiveJson[FileInfoJSON](conn)
+	err = validateFilePath(link_info)
+	if err != nil {
+		return err
+	}
+	err = validateLinkTarget(link_info.relPath(), link_info.LinkTarget)
+	if err != nil {
+		return err
+	}
+	sess, err := l.checkOffered(conn, request_header, link_info)
 	if err != nil {
 		return err
 	}
-	log.Debug("file_info=%#v", file_info)
 
-	var file_dir string
-	active_file, ok := l.activeFileDownloads.Get(request_header.UUID)
-	if !ok {
-		active_file = NewActiveFileDownload(NUMBER_OF_PARTS)
-		l.activeFileDownloads.Set(request_header.UUID, active_file)
+	link_name, err := makeSymlink(l.DownloadsDir, link_info.relPath(), filepath.FromSlash(link_info.LinkTarget))
+	sess.fileDone(link_info.relPath(), link_name, err)
+	if err != nil {
+		return err
+	}
+	log.Info("Created symlink `%s` -> `%s`", link_name, link_info.LinkTarget)
+	return nil
+}
 
-		file_dir, err = tryMakeNewDir(path.Join(l.DownloadsDir, file_info.Name))
-		if err != nil {
-			return err
+func validateFileInfo(file_info FileInfoJSON) error {
+	err := validateFilePath(file_info)
+	if err != nil {
+		return err
+	}
+	_, err = file_info.HashAlgorithm.New()
+	if err != nil {
+		return err
+	}
+	if file_info.Parts < 1 || file_info.Parts > MAX_NUMBER_OF_PARTS {
+		return fmt.Errorf("%w: %d", ErrInvalidNumberOfParts, file_info.Parts)
+	}
+	if file_info.Size < 0 {
+		return fmt.Errorf("%w: size %d", ErrInvalidFileRange, file_info.Size)
+	}
+	if file_info.ChunkSize <= 0 || file_info.ChunkSize > MAX_CHUNK_SIZE {
+		return fmt.Errorf("%w: chunk size %d", ErrInvalidFileRange, file_info.ChunkSize)
+	}
+
+	// The part hashes must lead up to the root of the hash tree
+	if len(file_info.PartHashes) != file_info.Parts {
+		return fmt.Errorf("%w: %d part hashes for %d parts", ErrPartHashMismatch, len(file_info.PartHashes), file_info.Parts)
+	}
+	file_hash, err := fileDigest(file_info.HashAlgorithm, file_info.PartHashes)
+	if err != nil {
+		return err
+	}
+	if !hashesEqual(file_hash, file_info.FileHash) {
+		return fmt.Errorf("%w: expected %s, got %s", ErrFileHashMismatch, file_info.FileHash, file_hash)
+	}
+	return nil
+}
+
+func validatePartInfo(file_info FileInfoJSON) error {
+	if file_info.PartNumber < 0 || file_info.PartNumber >= file_info.Parts {
+		return fmt.Errorf("%w: %d/%d", ErrInvalidPartNumber, file_info.PartNumber, file_info.Parts)
+	}
+	part_range := FileRange{Offset: file_info.Offset, Length: file_info.Length}
+	if part_range.Offset < 0 || part_range.Length < 0 || part_range.End() > file_info.Size {
+		return fmt.Errorf("%w: %s of %d bytes", ErrInvalidFileRange, part_range, file_info.Size)
+	}
+	if file_info.Resume < 0 || file_info.Resume > file_info.Length || file_info.Resume%file_info.ChunkSize != 0 {
+		return fmt.Errorf("%w: resume at %d of %d bytes", ErrInvalidFileRange, file_info.Resume, file_info.Length)
+	}
+
+	// The chunk hashes must lead up to the part hash
+	chunks := numberOfChunks(file_info.Length, file_info.ChunkSize)
+	if len(file_info.ChunkHashes) != chunks {
+		return fmt.Errorf("%w: %d chunk hashes for %d chunks", ErrChunkHashMismatch, len(file_info.ChunkHashes), chunks)
+	}
+	for i, chunk := range file_info.HoleChunks {
+		if chunk < 0 || chunk >= chunks || (i > 0 && chunk <= file_info.HoleChunks[i-1]) {
+			return fmt.Errorf("%w: hole chunk %d of %d", ErrInvalidFileRange, chunk, chunks)
 		}
+	}
+	part_hash, err := merkleRoot(file_info.HashAlgorithm, file_info.ChunkHashes)
+	if err != nil {
+		return err
+	}
+	if !hashesEqual(part_hash, file_info.PartHashes[file_info.PartNumber]) {
+		return fmt.Errorf("%w: part %d expected %s, got %s", ErrPartHashMismatch, file_info.PartNumber, file_info.PartHashes[file_info.PartNumber], part_hash)
+	}
+	return nil
+}
 
-		active_file.DirName = file_dir
+// receiveFilePart downloads a part into its own range of `file` and checks every
+// chunk against the chunk hashes in the header, asking the sender for the ones
+// that don't match again. The received bytes are synced and handed to
+// `checkpoint` periodically so the part can be resumed, and `progress` gets the
+// number of bytes of every read.
+func (conn *Conn) receiveFilePart(file *os.File, file_info FileInfoJSON, checkpoint func(written int64) error, progress func(n int)) error {
+	log.Debug("file_name=%#v, offset=%d, resume=%d", file.Name(), file_info.Offset, file_info.Resume)
+
+	// Hash the chunks kept from a previous attempt
+	resume_chunk := int(file_info.Resume / file_info.ChunkSize)
+	chunk_hashes, err := hashChunks(file, file_info, resume_chunk)
+	if err != nil {
+		return err
+	}
+	hasher, err := newChunkHasher(file_info.HashAlgorithm, file_info.ChunkSize)
+	if err != nil {
+		return err
 	}
-	file_dir = active_file.DirName
 
-	// Create the output file to add the content
-	file_name := path.Join(file_dir, file_info.PartName)
-	log.Debug("file_name=%#v", file_name)
-	file, err := os.Create(file_name)
+	body, body_done, err := conn.bodyConn(file_info.Compression, 0)
 	if err != nil {
-		return fmt.Errorf("On file create: %w", err)
+		return err
 	}
-	defer file.Close()
-	active_file.FileNames = append(active_file.FileNames, file_name)
+	defer body_done()
 
-	// Download the file using buffering
-	bufferedWriter := bufio.NewWriterSize(file, FILE_BUFFER_SIZE)
-	defer bufferedWriter.Flush()
+	// Download the rest of the part into its own range using buffering
+	bufferedWriter := bufio.NewWriterSize(io.NewOffsetWriter(file, file_info.Offset+file_info.Resume), FILE_BUFFER_SIZE)
+
+	// `written` is how far into the part everything is on disk, holes included
+	written := file_info.Resume
+	saved := written
+	save := func() error {
+		err := bufferedWriter.Flush()
+		if err != nil {
+			return fmt.Errorf("On flush: %w", err)
+		}
+		err = file.Sync()
+		if err != nil {
+			return fmt.Errorf("On sync: %w", err)
+		}
+		saved = written
+		return checkpoint(written)
+	}
 
 	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
 	acc_bytes := 0
-	total_bytes := 0
 	buf := make([]byte, TEMP_B_SIZE)
-	for {
-		n, err := conn.Read(buf)
-		if n > 0 {
-			// log.Info("Read %d bytes from %s", n, conn.RemoteAddr())
-			acc_bytes += n
-			total_bytes += n
-			// if total_bytes >= int(file_info.Size) {
-			// 	n -= total_bytes - int(file_info.Size)
-			// }
-			_, writeErr := bufferedWriter.Write(buf[:n])
-			if writeErr != nil {
-				return fmt.Errorf("write failed: %w", writeErr)
+	for _, run := range chunkRuns(file_info, resume_chunk) {
+		run_range := run.fileRange(file_info)
+
+		// Holes are left as they are in the temp file, which reads as zeros
+		if run.hole {
+			for chunk := run.first; chunk < run.last; chunk++ {
+				err = hasher.zeroChunk(file_info.HashAlgorithm, chunkRange(file_info, chunk).Length)
+				if err != nil {
+					return err
+				}
 			}
+			written = run_range.End() - file_info.Offset
+			continue
+		}
+
+		err = bufferedWriter.Flush()
+		if err != nil {
+			return fmt.Errorf("On flush: %w", err)
+		}
+		bufferedWriter.Reset(io.NewOffsetWriter(file, run_range.Offset))
+		data := io.TeeReader(io.LimitReader(body, run_range.Length), hasher)
+
+		run_bytes := int64(0)
+		for {
+			n, err := data.Read(buf)
+			if n > 0 {
+				// log.Info("Read %d bytes from %s", n, conn.RemoteAddr())
+				acc_bytes += n
+				run_bytes += int64(n)
+				written += int64(n)
+				_, writeErr := bufferedWriter.Write(buf[:n])
+				if writeErr != nil {
+					return fmt.Errorf("write failed: %w", writeErr)
+				}
+
+				select {
+				case <-ticker.C:
+					transformed, unit := BestUnitOfData(acc_bytes / 3)
+					log.Info("Download Speed: %f %s/sec", transformed, unit)
+					acc_bytes = 0
+				default:
+				}
+				progress(n)
 
-			// if total_bytes >= int(file_info.Size) {
-			// 	return nil
-			// }
+				if written-saved >= RESUME_CHECKPOINT_SIZE {
+					save_err := save()
+					if save_err != nil {
+						return save_err
+					}
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				// Keep what made it so far for the next attempt
+				save_err := save()
+				if save_err != nil {
+					log.Warn("Couldn't save part %d: %s", file_info.PartNumber, save_err)
+				}
+				return fmt.Errorf("read failed: %w", err)
+			}
+		}
 
-			select {
-			case <-ticker.C:
-				transformed, unit := BestUnitOfData(acc_bytes / 3)
-				log.Info("Download Speed: %f %s/sec", transformed, unit)
-				acc_bytes = 0
-			default:
+		if run_bytes != run_range.Length {
+			save_err := save()
+			if save_err != nil {
+				log.Warn("Couldn't save part %d: %s", file_info.PartNumber, save_err)
 			}
-			reportDownloadProgress(file_info, total_bytes)
+			return fmt.Errorf("%w: received %d of %d bytes", ErrPartLengthMismatch, written, file_info.Length)
+		}
+	}
+
+	err = save()
+	if err != nil {
+		return err
+	}
+
+	if written != file_info.Length {
+		return fmt.Errorf("%w: received %d of %d bytes", ErrPartLengthMismatch, written, file_info.Length)
+	}
+
+	chunk_hashes = append(chunk_hashes, hasher.Leaves()...)
+	return conn.repairChunks(file, file_info, chunk_hashes)
+}
+
+// repairChunks asks the sender for every chunk whose hash doesn't match the
+// header until the whole part is verified.
+func (conn *Conn) repairChunks(file *os.File, file_info FileInfoJSON, chunk_hashes []string) error {
+	bad_chunks := []int{}
+	for i, chunk_hash := range chunk_hashes {
+		if !hashesEqual(chunk_hash, file_info.ChunkHashes[i]) {
+			bad_chunks = append(bad_chunks, i)
+		}
+	}
 
-			// // Periodically flush to reduce memory use
-			// if bufferedWriter.Buffered() > FILE_BUFFER_SIZE/2 {
-			// 	_ = bufferedWriter.Flush()
-			// }
+	for round := 0; len(bad_chunks) > 0; round++ {
+		if round == MAX_CHUNK_ROUNDS {
+			_, err := conn.sendMessage(ChunkRequestJSON{Failed: true})
+			if err != nil {
+				log.Warn("Couldn't tell the sender about part %d: %s", file_info.PartNumber, err)
+			}
+			return fmt.Errorf("%w: part %d still has %d bad chunks", ErrChunkHashMismatch, file_info.PartNumber, len(bad_chunks))
+		}
 
+		log.Warn("Part %d has %d bad chunks, asking for them again", file_info.PartNumber, len(bad_chunks))
+		_, err := conn.sendMessage(ChunkRequestJSON{Chunks: bad_chunks})
+		if err != nil {
+			return err
 		}
-		if err == io.EOF {
-			_ = bufferedWriter.Flush()
-			break
+
+		still_bad := []int{}
+		for _, chunk := range bad_chunks {
+			chunk_range := chunkRange(file_info, chunk)
+			hasher, err := newChunkHasher(file_info.HashAlgorithm, file_info.ChunkSize)
+			if err != nil {
+				return err
+			}
+
+			w := io.MultiWriter(io.NewOffsetWriter(file, chunk_range.Offset), hasher)
+			_, err = io.CopyN(w, conn, chunk_range.Length)
+			if err != nil {
+				return fmt.Errorf("On receive chunk %d: %w", chunk, err)
+			}
+			if !hashesEqual(hasher.Leaves()[0], file_info.ChunkHashes[chunk]) {
+				still_bad = append(still_bad, chunk)
+			}
 		}
+		bad_chunks = still_bad
+
+		err = file.Sync()
 		if err != nil {
-			return fmt.Errorf("read failed: %w", err)
+			return fmt.Errorf("On sync: %w", err)
 		}
 	}
-	return nil
-}
 
-func reportDownloadProgress(file_info FileInfoJSON, bytes_downloaded int) {
-	// log.Info("Downloaded `%d/%d` %f%%", temp_file.Size(), file_info.Size, float64(temp_file.Size())/float64(file_info.Size))
+	_, err := conn.sendMessage(ChunkRequestJSON{})
+	return err
 }
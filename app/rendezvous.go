@@ -0,0 +1,210 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/NikosGour/logging/src"
+)
+
+const (
+	RENDEZVOUS_PORT = 6970
+	// How long a listener stays registered without registering again
+	RENDEZVOUS_EXPIRY = 60 * time.Second
+	// How often a listener registers again, which also keeps its NAT mapping open
+	RENDEZVOUS_INTERVAL = 15 * time.Second
+	// How often a register is sent again while there is no answer
+	RENDEZVOUS_RETRY = time.Second
+	// How long to wait for the rendezvous to answer at all
+	RENDEZVOUS_TIMEOUT  = 10 * time.Second
+	MAX_RENDEZVOUS_SIZE = 1 * KiB
+)
+
+// rendezvous_magic starts every rendezvous message. Its first byte keeps it
+// apart from QUIC packets on the same socket.
+const rendezvous_magic = "\x00BDP-RDV"
+
+const (
+	RENDEZVOUS_REGISTER   = "register"
+	RENDEZVOUS_REGISTERED = "registered"
+	RENDEZVOUS_UNREGISTER = "unregister"
+	RENDEZVOUS_PEER       = "peer"
+	RENDEZVOUS_ERROR      = "error"
+)
+
+const (
+	ROLE_LISTENER = "listener"
+	ROLE_DIALER   = "dialer"
+)
+
+var (
+	ErrRendezvousTimeout = errors.New("The rendezvous didn't answer")
+	ErrInvalidRendezvous = errors.New("Invalid rendezvous message")
+)
+
+// RendezvousJSON is a message between a peer and the rendezvous. The endpoints
+// are the public ones the rendezvous sees, after any NAT.
+type RendezvousJSON struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+	Role string `json:"role,omitempty"`
+	// Local is the endpoint the peer thinks it has, only for logging
+	Local string `json:"local,omitempty"`
+	// Endpoint is the endpoint of the peer the message is sent to
+	Endpoint string `json:"endpoint,omitempty"`
+	// Peer is the endpoint of the other peer
+	Peer  string `json:"peer,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// rendezvous_errors are the errors the rendezvous can answer with.
+var rendezvous_errors = []error{ErrNoListener, ErrAddressInUse, ErrInvalidRendezvous}
+
+func (rj RendezvousJSON) err() error {
+	if rj.Type != RENDEZVOUS_ERROR {
+		return nil
+	}
+	for _, rendezvous_err := range rendezvous_errors {
+		if rj.Error == rendezvous_err.Error() {
+			return fmt.Errorf("%w: `%s`", rendezvous_err, rj.Name)
+		}
+	}
+	return fmt.Errorf("Rendezvous error: %s", rj.Error)
+}
+
+func encodeRendezvous(message RendezvousJSON) ([]byte, error) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("On marshal: %w", err)
+	}
+	return append([]byte(rendezvous_magic), data...), nil
+}
+
+// decodeRendezvous is the message in `packet`, false if it isn't one.
+func decodeRendezvous(packet []byte) (RendezvousJSON, bool) {
+	var message RendezvousJSON
+	data, ok := bytes.CutPrefix(packet, []byte(rendezvous_magic))
+	if !ok || json.Unmarshal(data, &message) != nil {
+		return message, false
+	}
+	return message, true
+}
+
+func writeRendezvous(conn interface {
+	WriteTo([]byte, net.Addr) (int, error)
+}, message RendezvousJSON, addr net.Addr) error {
+	packet, err := encodeRendezvous(message)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(packet, addr)
+	return err
+}
+
+type registration struct {
+	endpoint *net.UDPAddr
+	seen     time.Time
+}
+
+// RendezvousServer introduces peers that can't reach each other directly. A
+// listener registers under a name, and when a dialer registers for the same
+// name both are told the public endpoint of the other, so they can punch a
+// path through their NATs.
+type RendezvousServer struct {
+	listeners map[string]registration
+	mu        sync.Mutex
+}
+
+func NewRendezvousServer() *RendezvousServer {
+	return &RendezvousServer{listeners: map[string]registration{}}
+}
+
+// Serve answers the peers on `conn` until it is closed.
+func (rs *RendezvousServer) Serve(conn net.PacketConn) error {
+	log.Info("Rendezvous on `%s`", conn.LocalAddr())
+	packet := make([]byte, MAX_RENDEZVOUS_SIZE)
+	for {
+		n, addr, err := conn.ReadFrom(packet)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("On read: %w", err)
+		}
+		endpoint, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		message, ok := decodeRendezvous(packet[:n])
+		if !ok {
+			log.Debug("Ignoring a packet from `%s`", endpoint)
+			continue
+		}
+		for _, reply := range rs.handle(message, endpoint) {
+			err = writeRendezvous(conn, reply.message, reply.to)
+			if err != nil {
+				log.Warn("Couldn't answer `%s`: %s", reply.to, err)
+			}
+		}
+	}
+}
+
+type rendezvousReply struct {
+	message RendezvousJSON
+	to      *net.UDPAddr
+}
+
+// handle is what the rendezvous answers to `message` from `endpoint`.
+func (rs *RendezvousServer) handle(message RendezvousJSON, endpoint *net.UDPAddr) []rendezvousReply {
+	fail := func(err error) []rendezvousReply {
+		return []rendezvousReply{{RendezvousJSON{Type: RENDEZVOUS_ERROR, Name: message.Name, Error: err.Error()}, endpoint}}
+	}
+	if message.Name == "" {
+		return fail(ErrInvalidRendezvous)
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	listener, registered := rs.listeners[message.Name]
+	if registered && time.Since(listener.seen) > RENDEZVOUS_EXPIRY {
+		delete(rs.listeners, message.Name)
+		registered = false
+	}
+	is_listener := registered && listener.endpoint.String() == endpoint.String()
+
+	switch {
+	case message.Type == RENDEZVOUS_REGISTER && message.Role == ROLE_LISTENER:
+		if registered && !is_listener {
+			return fail(ErrAddressInUse)
+		}
+		if !registered {
+			log.Info("`%s` listens as `%s` (local `%s`)", endpoint, message.Name, message.Local)
+		}
+		rs.listeners[message.Name] = registration{endpoint: endpoint, seen: time.Now()}
+		return []rendezvousReply{{RendezvousJSON{Type: RENDEZVOUS_REGISTERED, Name: message.Name, Endpoint: endpoint.String()}, endpoint}}
+
+	case message.Type == RENDEZVOUS_REGISTER && message.Role == ROLE_DIALER:
+		if !registered {
+			return fail(ErrNoListener)
+		}
+		log.Info("Introducing `%s` to `%s` as `%s` (local `%s`)", endpoint, listener.endpoint, message.Name, message.Local)
+		return []rendezvousReply{
+			{RendezvousJSON{Type: RENDEZVOUS_PEER, Name: message.Name, Endpoint: endpoint.String(), Peer: listener.endpoint.String()}, endpoint},
+			{RendezvousJSON{Type: RENDEZVOUS_PEER, Name: message.Name, Endpoint: listener.endpoint.String(), Peer: endpoint.String()}, listener.endpoint},
+		}
+
+	case message.Type == RENDEZVOUS_UNREGISTER:
+		if is_listener {
+			log.Info("`%s` stopped listening as `%s`", endpoint, message.Name)
+			delete(rs.listeners, message.Name)
+		}
+		return nil
+	}
+	return fail(ErrInvalidRendezvous)
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestRendezvousHandle(t *testing.T) {
+	listener := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2000}
+	dialer := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 3000}
+	register := func(role string) RendezvousJSON {
+		return RendezvousJSON{Type: RENDEZVOUS_REGISTER, Name: "name", Role: role}
+	}
+
+	// The steps run in order against the same rendezvous
+	tests := []struct {
+		name    string
+		message RendezvousJSON
+		from    *net.UDPAddr
+		want    []RendezvousJSON
+		to      []*net.UDPAddr
+	}{
+		{"dialer before the listener", register(ROLE_DIALER), dialer,
+			[]RendezvousJSON{{Type: RENDEZVOUS_ERROR, Name: "name", Error: ErrNoListener.Error()}}, []*net.UDPAddr{dialer}},
+		{"listener", register(ROLE_LISTENER), listener,
+			[]RendezvousJSON{{Type: RENDEZVOUS_REGISTERED, Name: "name", Endpoint: listener.String()}}, []*net.UDPAddr{listener}},
+		{"listener again", register(ROLE_LISTENER), listener,
+			[]RendezvousJSON{{Type: RENDEZVOUS_REGISTERED, Name: "name", Endpoint: listener.String()}}, []*net.UDPAddr{listener}},
+		{"name in use", register(ROLE_LISTENER), other,
+			[]RendezvousJSON{{Type: RENDEZVOUS_ERROR, Name: "name", Error: ErrAddressInUse.Error()}}, []*net.UDPAddr{other}},
+		{"dialer", register(ROLE_DIALER), dialer,
+			[]RendezvousJSON{
+				{Type: RENDEZVOUS_PEER, Name: "name", Endpoint: dialer.String(), Peer: listener.String()},
+				{Type: RENDEZVOUS_PEER, Name: "name", Endpoint: listener.String(), Peer: dialer.String()},
+			}, []*net.UDPAddr{dialer, listener}},
+		{"unregister by someone else", RendezvousJSON{Type: RENDEZVOUS_UNREGISTER, Name: "name"}, other, nil, nil},
+		{"still registered", register(ROLE_LISTENER), other,
+			[]RendezvousJSON{{Type: RENDEZVOUS_ERROR, Name: "name", Error: ErrAddressInUse.Error()}}, []*net.UDPAddr{other}},
+		{"unregister", RendezvousJSON{Type: RENDEZVOUS_UNREGISTER, Name: "name"}, listener, nil, nil},
+		{"dialer after unregister", register(ROLE_DIALER), dialer,
+			[]RendezvousJSON{{Type: RENDEZVOUS_ERROR, Name: "name", Error: ErrNoListener.Error()}}, []*net.UDPAddr{dialer}},
+		{"no name", RendezvousJSON{Type: RENDEZVOUS_REGISTER, Role: ROLE_LISTENER}, listener,
+			[]RendezvousJSON{{Type: RENDEZVOUS_ERROR, Error: ErrInvalidRendezvous.Error()}}, []*net.UDPAddr{listener}},
+		{"unknown type", RendezvousJSON{Type: "hello", Name: "name"}, listener,
+			[]RendezvousJSON{{Type: RENDEZVOUS_ERROR, Name: "name", Error: ErrInvalidRendezvous.Error()}}, []*net.UDPAddr{listener}},
+	}
+
+	rs := NewRendezvousServer()
+	for _, test := range tests {
+		replies := rs.handle(test.message, test.from)
+		if len(replies) != len(test.want) {
+			t.Fatalf("%s: got %d replies, want %d", test.name, len(replies), len(test.want))
+		}
+		for i, reply := range replies {
+			if reply.message != test.want[i] || reply.to != test.to[i] {
+				t.Fatalf("%s: got %+v to `%s`, want %+v to `%s`", test.name, reply.message, reply.to, test.want[i], test.to[i])
+			}
+		}
+	}
+
+	err := RendezvousJSON{Type: RENDEZVOUS_ERROR, Name: "name", Error: ErrNoListener.Error()}.err()
+	if !errors.Is(err, ErrNoListener) {
+		t.Fatalf("Got %v, want %v", err, ErrNoListener)
+	}
+}
@@ -2,18 +2,22 @@ package app
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/binary"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/hashicorp/yamux"
 	cmap "github.com/orcaman/concurrent-map/v2"
 
 	log "github.com/NikosGour/logging/src"
@@ -21,10 +25,54 @@ import (
 
 type UUID = uuid.UUID
 
+// HANDSHAKE_TIMEOUT bounds the TLS, pairing and authentication handshakes.
+const HANDSHAKE_TIMEOUT = 30 * time.Second
+
+var (
+	ErrTooManyParts   = errors.New("Too many parts")
+	ErrNotRegularFile = errors.New("Not a regular file")
+)
+
 type Sender struct {
-	port  int
-	addr  string
-	conns cmap.ConcurrentMap[UUID, net.Conn]
+	// Parts is the number of parts every file is split into, 0 picks it by file size
+	Parts int
+	// HashAlgorithm is used to verify every part and the whole file, empty uses the default
+	HashAlgorithm HashAlgorithm
+	// Symlinks is what happens to the symlinks inside the directories being sent,
+	// empty preserves them. Symlinks passed to SendFiles are always followed.
+	Symlinks SymlinkPolicy
+	// Compression is used for the parts that compress well, if the receiver supports it
+	Compression Compression
+	// CompressionLevel of `Compression`, 0 picks its default
+	CompressionLevel int
+	// Identity turns on TLS, the receiver is trusted by its fingerprint: it has
+	// to match `Fingerprint` if set, and `KnownPeers` if it was seen before
+	Identity    *Identity
+	KnownPeers  *KnownPeers
+	Fingerprint string
+	// PairingCode is the code the receiver printed, it authenticates the
+	// receiver and encrypts the connection
+	PairingCode string
+	// PreSharedKey answers the receiver's challenge, if it asks for one
+	PreSharedKey []byte
+	// JSONFrames sends every message as JSON instead of binary, for debugging
+	JSONFrames bool
+	// Multiplex sends everything over one connection, every request and part
+	// on a stream of its own
+	Multiplex bool
+	// Transport dials the receiver, nil dials over TCP
+	Transport Transport
+
+	port    int
+	addr    string
+	session UUID
+	// What the receiver agreed on when the session was offered
+	capabilities []Capability
+	conns        cmap.ConcurrentMap[UUID, net.Conn]
+
+	mux      *yamux.Session
+	mux_conn *Conn
+	mux_mu   sync.Mutex
 }
 
 func NewFileSender(port int, address string) *Sender {
@@ -36,20 +84,94 @@ func NewFileSender(port int, address string) *Sender {
 	return fs
 }
 
-func (fs *Sender) connect() (net.Conn, error) {
+// NewTransportFileSender sends to the Listener at `address` of `transport`.
+func NewTransportFileSender(transport Transport, address string) *Sender {
+	fs := &Sender{Transport: transport, addr: address}
+	fs.conns = cmap.NewStringer[UUID, net.Conn]()
+	return fs
+}
+
+// connect opens a connection for a request, a stream of the Sender's
+// connection when multiplexing.
+func (fs *Sender) connect() (*Conn, error) {
+	if fs.Multiplex {
+		return fs.connectMultiplexed()
+	}
+	return fs.dial()
+}
+
+func (fs *Sender) dial() (*Conn, error) {
 	//TODO: validate address
 	log.Info("Dialing: %s", fs.addr)
-	conn, err := net.Dial("tcp", fs.addr)
+	transport := fs.Transport
+	if transport == nil {
+		transport = TCPTransport{}
+	}
+	conn, err := transport.Dial(fs.addr)
 	if err != nil {
 		return nil, fmt.Errorf("On dial: %w", err)
 	}
 	log.Info("Connected on address: `%s`", fs.addr)
 
-	err = conn.(*net.TCPConn).SetNoDelay(true)
+	// A receiver that isn't set up the same way would leave the handshakes hanging
+	err = conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
 	if err != nil {
-		return nil, fmt.Errorf("On Nagle's: %w", err)
+		return nil, fmt.Errorf("On set deadline: %w", err)
+	}
+
+	// The hello goes first, a peer that can't talk to us says so before the
+	// handshakes of the rest fail in ways that don't
+	c := NewConn(conn)
+	c.json_frames = fs.JSONFrames
+	own := fs.hello()
+	err = c.hello(own)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("On hello: %w", err)
+	}
+
+	if fs.Identity != nil {
+		tls_conn := tls.Client(conn, fs.Identity.clientTLSConfig(fs.addr, fs.KnownPeers, fs.Fingerprint))
+		err = tls_conn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("On TLS handshake: %w", err)
+		}
+		conn = tls_conn
+		c.tls_conn = tls_conn
+	}
+
+	if fs.PairingCode != "" {
+		paired, err := pairConn(conn, fs.PairingCode, true)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("On pairing: %w", err)
+		}
+		conn = paired
+	}
+
+	if len(fs.PreSharedKey) > 0 {
+		err = authenticate(conn, fs.PreSharedKey)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("On authentication: %w", err)
+		}
+	}
+	c.c = conn
+
+	if c.secured() {
+		err = c.confirmHello(own)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("On hello: %w", err)
+		}
 	}
-	return conn, nil
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("On set deadline: %w", err)
+	}
+	return c, nil
 }
 
 func (conn *Conn) sendBytes(data io.Reader, request_header RequestHeader) error {
@@ -81,22 +203,23 @@ func (conn *Conn) sendHandlePackets(data io.Reader, request_header RequestHeader
 	if err != nil {
 		return err
 	}
-	//TODO fix
-	return conn.sendHandlePacketsNoRequestHeader(data, 0, packetHandling)
+	return conn.sendHandlePacketsNoRequestHeader(data, -1, packetHandling)
 }
 
-func (conn *Conn) sendHandlePacketsNoRequestHeader(data io.Reader, count int, packetHandling func(n int)) error {
+// sendHandlePacketsNoRequestHeader streams `data` into the connection, stopping
+// after `count` bytes. A negative `count` streams until EOF.
+func (conn *Conn) sendHandlePacketsNoRequestHeader(data io.Reader, count int64, packetHandling func(n int)) error {
+	if count >= 0 {
+		data = io.LimitReader(data, count)
+	}
+
 	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
 	acc_byte := 0
-	bytes_read := 0
 	buf := make([]byte, TEMP_B_SIZE)
 	for {
 		_n, err := data.Read(buf)
 		if _n > 0 {
-			bytes_read += _n
-			if bytes_read > count {
-				_n -= bytes_read - count
-			}
 			n, err := conn.Write(buf[:_n])
 			acc_byte += n
 			if err != nil {
@@ -128,188 +251,574 @@ func (conn *Conn) sendHandlePacketsNoRequestHeader(data io.Reader, count int, pa
 
 }
 func (conn *Conn) sendRequestHeader(request_header RequestHeader) error {
-	id_json, err := json.Marshal(request_header)
+	_, err := conn.sendMessage(request_header)
+	return err
+}
+
+func (conn *Conn) SendMessage(data any, request_header RequestHeader) (int64, error) {
+	err := conn.requestPrologue(request_header)
 	if err != nil {
-		return fmt.Errorf("On marshal header: %w", err)
+		return 0, err
 	}
+	return conn.sendMessage(data)
+}
 
-	n, err := conn.sendSmallBytes(id_json)
+func (conn *Conn) SendString(data string) error {
+	data_reader := bufio.NewReaderSize(strings.NewReader(data), FILE_BUFFER_SIZE)
+	rh := RequestHeader{UUID: uuid.New(), RequestType: RequestSendString}
+	log.Debug("request_header=%s", rh)
+
+	err := conn.sendBytes(data_reader, rh)
 	if err != nil {
 		return err
 	}
-	if n <= 0 {
-		log.Warn("Wrote `%d` bytes", n)
-	}
-	return nil
+
+	return conn.receiveStatus()
+}
+
+func (fs *Sender) SendFile(file_path string) error {
+	return fs.SendFiles([]string{file_path})
+}
+
+// requestHeader is the header of a request that is part of the session.
+func (fs *Sender) requestHeader(uuid UUID, request_type RequestType) RequestHeader {
+	return RequestHeader{UUID: uuid, RequestType: request_type, Session: fs.session}
 }
 
-func (conn *Conn) sendSmallBytes(data []byte) (int64, error) {
-	err := binary.Write(conn, binary.BigEndian, int64(len(data)))
+// sendFile sends the file at `file_path`, it is placed at `rel_path` under the
+// receiver's downloads dir.
+func (fs *Sender) sendFile(file_path string, rel_path string) error {
+	file, err := os.Open(file_path)
 	if err != nil {
-		return 0, fmt.Errorf("On write data size: %w", err)
+		return fmt.Errorf("On open: %w", err)
 	}
+	defer file.Close()
 
-	n, err := io.CopyN(conn, bytes.NewBuffer(data), int64(len(data)))
+	file_info, err := file.Stat()
 	if err != nil {
-		return 0, fmt.Errorf("On send data body: %w", err)
+		return fmt.Errorf("On file.Stat(): %w", err)
+	}
+	if !file_info.Mode().IsRegular() {
+		return fmt.Errorf("%w: `%s`", ErrNotRegularFile, file_path)
 	}
-	return n, nil
-}
 
-func (conn *Conn) SendJson(data any, request_header RequestHeader) (int64, error) {
-	err := conn.requestPrologue(request_header)
+	parts := fs.Parts
+	if parts <= 0 {
+		parts = NumberOfPartsForSize(file_info.Size())
+	}
+	if parts > MAX_NUMBER_OF_PARTS {
+		return fmt.Errorf("%w: %d > %d", ErrTooManyParts, parts, MAX_NUMBER_OF_PARTS)
+	}
+	log.Debug("Sending `%s` in %d parts", file_path, parts)
+
+	hash_algorithm := fs.HashAlgorithm
+	if hash_algorithm == "" {
+		hash_algorithm = DEFAULT_HASH_ALGORITHM
+	}
+	_, err = hash_algorithm.New()
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	file_info_json := FromFileInfo(file_info)
+	file_info_json.Path = filepath.ToSlash(rel_path)
+	file_info_json.Parts = parts
+	file_info_json.HashAlgorithm = hash_algorithm
+	file_info_json.ChunkSize = CHUNK_SIZE
+
+	// The same file gets the same UUID, so sending it again resumes it
+	uuid, err := transferUUID(file_path, file_info_json)
+	if err != nil {
+		return err
+	}
+
+	// The header carries the root of the hash tree, so hash the file up front
+	// even though that reads it once more than sending it does
+	part_infos := fs.splitFileIntoParts(file_info_json)
+	if slices.Contains(fs.capabilities, CapabilitySparse) {
+		err = markHoleChunks(file, part_infos)
+		if err != nil {
+			return err
+		}
+	}
+	file_hash, err := hashFileParts(file, part_infos)
+	if err != nil {
+		return err
 	}
-	return conn.sendJsonNoHeader(data)
+	file_info_json.FileHash = file_hash
+	file_info_json.PartHashes = part_infos[0].PartHashes
+	file_info_json.Sparse = part_infos[0].Sparse
+	log.Debug("file_hash=%s", file_hash)
+
+	state := ResumeStateJSON{}
+	if slices.Contains(fs.capabilities, CapabilityResume) {
+		state, err = fs.queryResumeState(uuid, file_info_json)
+		if err != nil {
+			return err
+		}
+	}
+
+	compression := negotiateCompression(fs.Compression, fs.capabilities)
+	if compression != fs.Compression && !fs.Compression.isNone() {
+		log.Warn("The receiver doesn't support %s compression, sending `%s` uncompressed", fs.Compression, file_path)
+	}
+
+	// Every part goes over its own connection, the first failure cancels the rest
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, len(part_infos))
+	sending := 0
+	for i, part_info := range part_infos {
+		if state.done(i) {
+			log.Debug("Part %d is already received", i)
+			continue
+		}
+
+		// Resume from the last whole chunk the receiver has
+		resume := min(state.written(i), part_info.Length)
+		part_info.Resume = resume - resume%part_info.ChunkSize
+		part_info.Compression = compression
+
+		sending++
+		go func() {
+			errs <- fs.sendFilePart(ctx, file, part_info, uuid)
+		}()
+	}
+
+	var first_err error
+	for range sending {
+		err := <-errs
+		if err != nil && first_err == nil {
+			first_err = err
+			cancel()
+		}
+	}
+
+	return first_err
 }
 
-func (conn *Conn) sendJsonNoHeader(data any) (int64, error) {
-	data_json, err := json.Marshal(data)
+// transferUUID identifies a transfer by the file's path, size, mod time and the
+// way it's split, so an unchanged file maps to the same transfer.
+func transferUUID(file_path string, file_info FileInfoJSON) (UUID, error) {
+	abs_path, err := filepath.Abs(file_path)
 	if err != nil {
-		return 0, fmt.Errorf("On marshal: %w", err)
+		return UUID{}, fmt.Errorf("On abs path: %w", err)
 	}
 
-	n, err := conn.sendSmallBytes(data_json)
+	name := fmt.Sprintf("%s\x00%d\x00%d\x00%d\x00%s",
+		abs_path, file_info.Size, file_info.ModTime.UnixNano(), file_info.Parts, file_info.HashAlgorithm)
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(name)), nil
+}
+
+// queryResumeState asks the receiver how much of the transfer it already has.
+func (fs *Sender) queryResumeState(uuid UUID, file_info FileInfoJSON) (ResumeStateJSON, error) {
+	conn, err := fs.connect()
 	if err != nil {
-		return 0, err
+		return ResumeStateJSON{}, err
 	}
+	defer conn.Close()
 
-	if n <= 0 {
-		log.Warn("Wrote `%d` bytes", n)
+	_, err = conn.SendMessage(file_info, fs.requestHeader(uuid, RequestResumeQuery))
+	if err != nil {
+		return ResumeStateJSON{}, err
 	}
 
-	return n, nil
+	state, err := receiveMessage[ResumeStateJSON](conn)
+	if err != nil {
+		return ResumeStateJSON{}, fmt.Errorf("On resume state: %w", err)
+	}
+	log.Debug("resume_state=%#v", state)
+	return state, conn.receiveStatus()
 }
 
-func (conn *Conn) SendString(data string) error {
-	data_reader := bufio.NewReaderSize(strings.NewReader(data), FILE_BUFFER_SIZE)
-	rh := RequestHeader{UUID: uuid.New(), RequestType: RequestSendString}
-	log.Debug("request_header=%s", rh)
+func (fs *Sender) sendFilePart(ctx context.Context, file io.ReaderAt, part_info FileInfoJSON, uuid UUID) error {
+	part_num := part_info.PartNumber
+	if ctx.Err() != nil {
+		return fmt.Errorf("On part %d: %w", part_num, ctx.Err())
+	}
 
-	err := conn.sendBytes(data_reader, rh)
+	conn, err := fs.connect()
+	if err != nil {
+		return fmt.Errorf("On part %d: %w", part_num, err)
+	}
+	defer conn.Close()
+
+	// Unblock any pending write if another part has failed
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if !part_info.Compression.isNone() {
+		ok, err := compressible(file, part_info, part_info.Compression, fs.CompressionLevel)
+		if err != nil {
+			return fmt.Errorf("On part %d: %w", part_num, err)
+		}
+		if !ok {
+			log.Debug("Part %d doesn't compress, sending it as is", part_num)
+			part_info.Compression = CompressionNone
+		}
+	}
+
+	log.Debug("Sending part %d: {Offset:%d, Length:%d, Resume:%d, Compression:%s}", part_num, part_info.Offset, part_info.Length, part_info.Resume, part_info.Compression)
+	err = conn.sendFilePart(file, part_info, fs.requestHeader(uuid, RequestSendFile), fs.CompressionLevel)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("On part %d: %w", part_num, ctx.Err())
+		}
+		return fmt.Errorf("On part %d: %w", part_num, err)
+	}
+	return nil
+}
+
+// markHoleChunks finds the chunks of every part that fall in a hole of `file`.
+func markHoleChunks(file *os.File, part_infos []FileInfoJSON) error {
+	if len(part_infos) == 0 {
+		return nil
+	}
+	extents, err := dataExtents(file, part_infos[0].Size)
 	if err != nil {
 		return err
 	}
 
+	sparse := false
+	for i := range part_infos {
+		part_infos[i].HoleChunks = holeChunks(part_infos[i], extents)
+		sparse = sparse || len(part_infos[i].HoleChunks) > 0
+	}
+	for i := range part_infos {
+		part_infos[i].Sparse = sparse
+	}
+	if sparse {
+		log.Debug("`%s` is sparse, %d data extents", part_infos[0].Name, len(extents))
+	}
 	return nil
 }
 
-func (fs *Sender) SendFile(file_path string) error {
+// splitFileIntoParts describes every part of the file by its byte range.
+func (fs *Sender) splitFileIntoParts(file_info FileInfoJSON) []FileInfoJSON {
+	ranges := SplitIntoRanges(file_info.Size, file_info.Parts)
+
+	part_infos := make([]FileInfoJSON, len(ranges))
+	for i, part_range := range ranges {
+		part_info := file_info
+		part_info.PartName = part_info.Name + strconv.Itoa(i)
+		part_info.PartNumber = i
+		part_info.Offset = part_range.Offset
+		part_info.Length = part_range.Length
+		part_infos[i] = part_info
+	}
+
+	return part_infos
+}
+
+// sendFilePart streams a part, skipping the bytes the receiver already has, and
+// then sends again any chunks the receiver couldn't verify. The parts are read
+// with ReadAt so they can be sent concurrently.
+func (conn *Conn) sendFilePart(file io.ReaderAt, part_info FileInfoJSON, rh RequestHeader, compression_level int) error {
+	log.Debug("request_header=%s", rh)
 
-	readers, part_size, err := fs.splitFileIntoParts(file_path)
+	err := conn.sendRequestHeader(rh)
 	if err != nil {
 		return err
 	}
-	file_info, err := os.Stat(file_path)
+
+	_n, err := conn.sendMessage(part_info)
 	if err != nil {
-		return fmt.Errorf("On Stat: %w", err)
+		return err
+	}
+	if _n <= 0 {
+		log.Warn("Wrote `%d` bytes", _n)
 	}
 
-	// Todo:  Split file in part and send
-	uuid := uuid.New()
-	for i, reader := range readers {
-		_conn, err := fs.connect()
+	body, body_done, err := conn.bodyConn(part_info.Compression, compression_level)
+	if err != nil {
+		return err
+	}
+
+	// Only the data chunks from the resume point on are sent, in order
+	for _, run := range chunkRuns(part_info, int(part_info.Resume/part_info.ChunkSize)) {
+		if run.hole {
+			continue
+		}
+		run_range := run.fileRange(part_info)
+		r := io.NewSectionReader(file, run_range.Offset, run_range.Length)
+		err = body.sendHandlePacketsNoRequestHeader(r, run_range.Length, func(n int) {
+			// log.Info("Wrote %d bytes into %s", n, fs.conn.RemoteAddr())
+		})
 		if err != nil {
+			body_done()
 			return err
 		}
-		conn := NewConn(_conn)
+	}
+	err = body_done()
+	if err != nil {
+		return err
+	}
 
-		log.Debug("Sending part %d", i)
-		err = conn.sendFilePart(reader, part_size, file_info, i, uuid)
+	chunks := numberOfChunks(part_info.Length, part_info.ChunkSize)
+	for round := 0; round <= MAX_CHUNK_ROUNDS; round++ {
+		request, err := receiveMessage[ChunkRequestJSON](conn)
 		if err != nil {
+			return fmt.Errorf("On chunk request: %w", err)
+		}
+		if request.Failed {
+			err = conn.receiveStatus()
+			if err == nil {
+				err = fmt.Errorf("%w: receiver gave up on part %d", ErrChunkHashMismatch, part_info.PartNumber)
+			}
 			return err
 		}
-	}
+		if len(request.Chunks) == 0 {
+			return conn.receiveStatus()
+		}
 
-	return nil
+		log.Warn("Sending again %d chunks of part %d", len(request.Chunks), part_info.PartNumber)
+		for _, chunk := range request.Chunks {
+			if chunk < 0 || chunk >= chunks {
+				return fmt.Errorf("%w: chunk %d of %d", ErrInvalidFileRange, chunk, chunks)
+			}
+			chunk_range := chunkRange(part_info, chunk)
+			r := io.NewSectionReader(file, chunk_range.Offset, chunk_range.Length)
+			err = conn.sendHandlePacketsNoRequestHeader(r, chunk_range.Length, func(n int) {})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("%w: part %d", ErrChunkHashMismatch, part_info.PartNumber)
 }
 
-func (fs *Sender) splitFileIntoParts(file_path string) ([]*bufio.Reader, int64, error) {
-	file, err := os.Open(file_path)
-	if err != nil {
-		return nil, 0, fmt.Errorf("On open: %w", err)
+// SendFiles sends every file, directories are sent with everything in them.
+// They are sent as one session: the receiver is offered the manifest of all of
+// it first, may decline it, and reports how every file turned out at the end.
+func (fs *Sender) SendFiles(file_paths []string) error {
+	entries := []sendEntry{}
+	for i, file_path := range file_paths {
+		file_entries, err := fs.planPath(file_path)
+		if err != nil {
+			return fmt.Errorf("On file number=`%d`, file_path=`%s` : %w", i, file_path, err)
+		}
+		for j := range file_entries {
+			file_entries[j].arg = i
+		}
+		entries = append(entries, file_entries...)
 	}
-	file_info, err := file.Stat()
+
+	offer_files := make([]FileInfoJSON, len(entries))
+	for i, entry := range entries {
+		offer_files[i] = entry.info
+	}
+	session, err := fs.sendOffer(offer_files)
 	if err != nil {
-		return nil, 0, fmt.Errorf("On file.Stat(): %w", err)
+		return err
 	}
+	fs.session = session
 
-	files := []*os.File{}
-
-	for i := 0; i < NUMBER_OF_PARTS; i++ {
-		file, err := os.Open(file_path)
+	send_err := fs.sendEntries(entries, file_paths)
+	result, err := fs.endSession(send_err)
+	if send_err != nil {
 		if err != nil {
-			return nil, 0, fmt.Errorf("On open: %w", err)
+			log.Warn("Couldn't end session %s: %s", session, err)
 		}
-		files = append(files, file)
+		return send_err
+	}
+	if err != nil {
+		return fmt.Errorf("On end session: %w", err)
 	}
 
-	file_parts := [NUMBER_OF_PARTS]*bufio.Reader{}
-	part_size := int64(file_info.Size() / 4)
+	failed := result.Failed()
+	for _, file_result := range failed {
+		log.Warn("`%s` wasn't received: %s", file_result.Path, file_result.Error)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%w: %d of %d failed, first `%s`: %w", ErrSessionIncomplete, len(failed), len(result.Files), failed[0].Path, failed[0].Err())
+	}
+	log.Info("Session %s complete: sent %d entries", session, len(result.Files))
+	return nil
+}
 
-	for i := 0; i < NUMBER_OF_PARTS; i += 1 {
-		seek_pos := part_size * int64(i)
-		_, err := files[i].Seek(seek_pos, 0)
+func (fs *Sender) sendEntries(entries []sendEntry, file_paths []string) error {
+	for _, entry := range entries {
+		var err error
+		switch entry.info.requestType() {
+		case RequestSendFile:
+			err = fs.sendFile(entry.path, entry.info.Path)
+		default:
+			err = fs.sendTreeEntry(entry.info)
+		}
 		if err != nil {
-			return nil, 0, fmt.Errorf("On seek: %w", err)
+			return fmt.Errorf("On file number=`%d`, file_path=`%s` : On `%s`: %w", entry.arg, file_paths[entry.arg], entry.info.Path, err)
 		}
-		file_parts[i] = bufio.NewReaderSize(files[i], FILE_BUFFER_SIZE)
+
+		log.Debug("Succesfully sent: `%s`", entry.info.Path)
 	}
+	return nil
+}
 
-	// for i, v := range file_parts {
-	// 	buf, _, err := v.ReadLine()
-	// 	if err != nil && err != io.EOF {
-	// 		return nil, 0, fmt.Errorf("On readLine: %w", err)
-	// 	}
-	// 	log.Debug("buf%d=%s", i, string(buf[:NUMBER_OF_PARTS]))
+// SendDir sends the directory tree at `dir_path`, including empty directories.
+// Every entry is placed under the directory's name on the receiver, symlinks
+// are handled as `Symlinks` says.
+func (fs *Sender) SendDir(dir_path string) error {
+	return fs.SendFiles([]string{dir_path})
+}
 
-	// }
-	return file_parts[:], part_size, nil
+// sendEntry is a file, directory or symlink to send, `info.Path` is where it
+// goes on the receiver.
+type sendEntry struct {
+	path string
+	info FileInfoJSON
+	arg  int
 }
-func (conn *Conn) sendFilePart(r *bufio.Reader, n int64, file_info os.FileInfo, part_num int, uuid UUID) error {
-	rh := RequestHeader{UUID: uuid, RequestType: RequestSendFile}
-	log.Debug("request_header=%s", rh)
 
-	err := conn.sendRequestHeader(rh)
+func newSendEntry(entry_path string, rel_path string, info os.FileInfo) sendEntry {
+	info_json := FromFileInfo(info)
+	info_json.Path = filepath.ToSlash(rel_path)
+	return sendEntry{path: entry_path, info: info_json}
+}
+
+// planPath lists what sending `file_path` takes, a file is placed under its
+// name on the receiver.
+func (fs *Sender) planPath(file_path string) ([]sendEntry, error) {
+	file_info, err := os.Stat(file_path)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("On Stat: %w", err)
 	}
-	file_info_json := FromFileInfo(file_info)
-	file_info_json.Size = n
-	file_info_json.PartName = file_info_json.Name + strconv.Itoa(part_num)
 
-	_n, err := conn.sendJsonNoHeader(file_info_json)
+	if file_info.IsDir() {
+		return fs.planDir(file_path)
+	}
+	if !file_info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: `%s`", ErrNotRegularFile, file_path)
+	}
+	return []sendEntry{newSendEntry(file_path, filepath.Base(file_path), file_info)}, nil
+}
+
+func (fs *Sender) planDir(dir_path string) ([]sendEntry, error) {
+	abs_path, err := filepath.Abs(dir_path)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("On abs path: %w", err)
 	}
-	if _n <= 0 {
-		log.Warn("Wrote `%d` bytes", _n)
+	dir_info, err := os.Stat(abs_path)
+	if err != nil {
+		return nil, fmt.Errorf("On Stat: %w", err)
 	}
 
-	err = conn.sendHandlePacketsNoRequestHeader(r, int(n), func(n int) {
-		// log.Info("Wrote %d bytes into %s", n, fs.conn.RemoteAddr())
-	})
+	entries := []sendEntry{}
+	dirs := []sendEntry{}
+	err = fs.planTree(abs_path, filepath.Base(abs_path), []os.FileInfo{dir_info}, &entries, &dirs)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+
+	// Directories go last, deepest first, so adding their contents on the
+	// receiver doesn't undo their mod time
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries = append(entries, dirs[i])
+	}
+	return entries, nil
 }
 
-func (fs *Sender) SendFiles(file_paths []string) error {
+// planTree lists the files and symlinks under `dir_path`, which is placed at
+// `rel_path` on the receiver, into `entries` and its directories into `dirs`.
+// `ancestors` are the directories above it, so following a link can't loop forever.
+func (fs *Sender) planTree(dir_path string, rel_path string, ancestors []os.FileInfo, entries *[]sendEntry, dirs *[]sendEntry) error {
+	*dirs = append(*dirs, newSendEntry(dir_path, rel_path, ancestors[len(ancestors)-1]))
 
-	for i, file_path := range file_paths {
-		err := fs.SendFile(file_path)
+	dir_entries, err := os.ReadDir(dir_path)
+	if err != nil {
+		return fmt.Errorf("On ReadDir: %w", err)
+	}
+
+	for _, entry := range dir_entries {
+		entry_path := filepath.Join(dir_path, entry.Name())
+		entry_rel_path := filepath.Join(rel_path, entry.Name())
+
+		entry_info, err := entry.Info()
 		if err != nil {
-			return fmt.Errorf("On file number=`%d`, file_path=`%s` : %w", i, file_path, err)
+			return fmt.Errorf("On `%s`: %w", entry_rel_path, err)
+		}
+
+		if entry_info.Mode()&os.ModeSymlink != 0 {
+			switch fs.Symlinks {
+			case SymlinkSkip:
+				log.Info("Skipping symlink `%s`", entry_path)
+				continue
+			case SymlinkFollow:
+				entry_info, err = os.Stat(entry_path)
+				if err != nil {
+					log.Warn("Skipping `%s`, can't follow symlink: %s", entry_path, err)
+					continue
+				}
+			default:
+				link_entry, ok, err := planSymlink(entry_path, entry_rel_path, entry_info)
+				if err != nil {
+					return fmt.Errorf("On `%s`: %w", entry_rel_path, err)
+				}
+				if ok {
+					*entries = append(*entries, link_entry)
+				}
+				continue
+			}
 		}
 
-		log.Debug("Succesfully sent file: `%s`", file_path)
+		switch {
+		case entry_info.IsDir():
+			if slices.ContainsFunc(ancestors, func(ancestor os.FileInfo) bool { return os.SameFile(ancestor, entry_info) }) {
+				log.Warn("Skipping `%s`, symlink loop", entry_path)
+				continue
+			}
+			err = fs.planTree(entry_path, entry_rel_path, append(slices.Clip(ancestors), entry_info), entries, dirs)
+			if err != nil {
+				return err
+			}
+		case entry_info.Mode().IsRegular():
+			*entries = append(*entries, newSendEntry(entry_path, entry_rel_path, entry_info))
+		default:
+			log.Warn("Skipping `%s`, not a regular file", entry_path)
+		}
 	}
 	return nil
 }
 
+// planSymlink recreates the link at `link_path` on the receiver, pointing where
+// it points, unless it points outside the tree.
+func planSymlink(link_path string, rel_path string, link_info os.FileInfo) (sendEntry, bool, error) {
+	target, err := os.Readlink(link_path)
+	if err != nil {
+		return sendEntry{}, false, fmt.Errorf("On Readlink: %w", err)
+	}
+	link_entry := newSendEntry(link_path, rel_path, link_info)
+	link_entry.info.LinkTarget = filepath.ToSlash(target)
+
+	err = validateLinkTarget(link_entry.info.Path, link_entry.info.LinkTarget)
+	if err != nil {
+		log.Warn("Skipping `%s`: %s", link_path, err)
+		return sendEntry{}, false, nil
+	}
+	return link_entry, true, nil
+}
+
+// sendTreeEntry tells the receiver to create a directory or symlink.
+func (fs *Sender) sendTreeEntry(entry_info FileInfoJSON) error {
+	conn, err := fs.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.SendMessage(entry_info, fs.requestHeader(uuid.New(), entry_info.requestType()))
+	if err != nil {
+		return err
+	}
+
+	return conn.receiveStatus()
+}
+
 func (fs *Sender) Close() error {
-	//TODO: implement
-	return nil
+	fs.mux_mu.Lock()
+	defer fs.mux_mu.Unlock()
+	if fs.mux == nil {
+		return nil
+	}
+	return fs.mux.Close()
 }
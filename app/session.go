@@ -0,0 +1,350 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	log "github.com/NikosGour/logging/src"
+)
+
+var ErrSessionIncomplete = errors.New("Not every file of the session was received")
+
+const (
+	SESSION_PROGRESS_INTERVAL = 3 * time.Second
+	// How long the end of a session waits for the files still being received
+	SESSION_END_TIMEOUT = 30 * time.Second
+	// How long a session is kept without any request, a sender that went away
+	// never ends it
+	SESSION_IDLE_TIMEOUT = 10 * time.Minute
+)
+
+type FileStatus string
+
+const (
+	FileReceived FileStatus = "received"
+	FileFailed   FileStatus = "failed"
+)
+
+// FileResultJSON is how a file of a session turned out on the receiver.
+type FileResultJSON struct {
+	Path    string     `json:"path"`
+	Status  FileStatus `json:"status"`
+	SavedAs string     `json:"saved_as"`
+	Code    ErrorCode  `json:"code"`
+	Error   string     `json:"error"`
+}
+
+// Err is why the file failed, as a RemoteError on the sender.
+func (fr FileResultJSON) Err() error {
+	return remoteError(fr.Code, fr.Error)
+}
+
+// SessionResultJSON is the outcome of a whole session, once every file is
+// received or the sender has ended it.
+type SessionResultJSON struct {
+	Session UUID             `json:"session"`
+	Peer    string           `json:"peer"`
+	Files   []FileResultJSON `json:"files"`
+	// SenderCode and SenderError are why the sender stopped early, if it did
+	SenderCode  ErrorCode `json:"sender_code"`
+	SenderError string    `json:"sender_error"`
+}
+
+// Failed returns the files that weren't received.
+func (sr SessionResultJSON) Failed() []FileResultJSON {
+	failed := []FileResultJSON{}
+	for _, file_result := range sr.Files {
+		if file_result.Status != FileReceived {
+			failed = append(failed, file_result)
+		}
+	}
+	return failed
+}
+
+// EndSessionJSON tells the receiver the sender is done with a session.
+type EndSessionJSON struct {
+	Code  ErrorCode `json:"code"`
+	Error string    `json:"error"`
+}
+
+// session tracks the files of an accepted offer as they are received.
+type session struct {
+	id          UUID
+	offer       OfferJSON
+	host        string
+	fingerprint string
+	files       map[string]*sessionFile
+	on_complete func(result SessionResultJSON)
+
+	received    int64
+	files_done  int
+	active      int
+	timed_out   bool
+	last_report time.Time
+	last_used   time.Time
+	expiry      *time.Timer
+	result      *SessionResultJSON
+	mu          sync.Mutex
+	idle        *sync.Cond
+}
+
+type sessionFile struct {
+	info     FileInfoJSON
+	received int64
+	result   FileResultJSON
+}
+
+func newSession(id UUID, offer OfferJSON, host string, fingerprint string) *session {
+	sess := &session{id: id, offer: offer, host: host, fingerprint: fingerprint, last_report: time.Now(), last_used: time.Now()}
+	sess.files = map[string]*sessionFile{}
+	for _, file_info := range offer.Files {
+		sess.files[file_info.relPath()] = &sessionFile{info: file_info, result: FileResultJSON{Path: file_info.relPath()}}
+	}
+	sess.idle = sync.NewCond(&sess.mu)
+	return sess
+}
+
+// start and stop bracket every request that is receiving a file of the session.
+func (s *session) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active++
+}
+
+func (s *session) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	s.last_used = time.Now()
+	s.idle.Broadcast()
+}
+
+// touch keeps the session from expiring, every request of it calls it.
+func (s *session) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last_used = time.Now()
+}
+
+// expireWhenIdle removes the session from `l` once it went SESSION_IDLE_TIMEOUT
+// without a request, completing it if the sender never ended it.
+func (l *Listener) expireWhenIdle(s *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expiry = time.AfterFunc(SESSION_IDLE_TIMEOUT, func() { l.expire(s) })
+}
+
+// expire removes the session if it is idle, or checks again when it could be.
+func (l *Listener) expire(s *session) {
+	s.mu.Lock()
+	idle := time.Since(s.last_used)
+	// A file being received keeps it going however long it takes
+	if s.active > 0 {
+		s.expiry.Reset(SESSION_IDLE_TIMEOUT)
+		s.mu.Unlock()
+		return
+	}
+	if idle < SESSION_IDLE_TIMEOUT {
+		s.expiry.Reset(SESSION_IDLE_TIMEOUT - idle)
+		s.mu.Unlock()
+		return
+	}
+	completed := s.result == nil
+	if completed {
+		log.Warn("Session %s: nothing for %s, the sender is gone", s.id, idle.Round(time.Second))
+		s.complete(fmt.Errorf("%w: the sender went away", ErrCancelled))
+	}
+	result := *s.result
+	s.mu.Unlock()
+
+	l.sessions.Remove(s.id)
+	if completed {
+		s.notify(result)
+	}
+}
+
+// progress counts `n` more bytes of the file at `rel_path` and reports the
+// progress of the whole session every SESSION_PROGRESS_INTERVAL.
+func (s *session) progress(rel_path string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[rel_path]
+	if !ok {
+		return
+	}
+	n = int(min(int64(n), file.info.Size-file.received))
+	file.received += int64(n)
+	s.received += int64(n)
+
+	if time.Since(s.last_report) >= SESSION_PROGRESS_INTERVAL {
+		s.last_report = time.Now()
+		s.report()
+	}
+}
+
+// report logs the progress of the session, the caller must hold `mu`.
+func (s *session) report() {
+	total := s.offer.TotalSize()
+	percent := 100.0
+	if total > 0 {
+		percent = 100 * float64(s.received) / float64(total)
+	}
+	size, unit := BestUnitOfData(int(total))
+	log.Info("Session %s: %d of %d entries, %.1f%% of %.2f %s", s.id, s.files_done, len(s.files), percent, size, unit)
+}
+
+// fileDone records how the file at `rel_path` turned out. A failed file may
+// still be sent again, so it only counts as failed if the session ends first.
+func (s *session) fileDone(rel_path string, saved_as string, err error) {
+	result, completed := s.recordFile(rel_path, saved_as, err)
+	if completed {
+		s.notify(result)
+	}
+}
+
+// recordFile is fileDone under `mu`, it returns the result if the file was
+// the last one the session was waiting for.
+func (s *session) recordFile(rel_path string, saved_as string, err error) (SessionResultJSON, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[rel_path]
+	if !ok || file.result.Status == FileReceived {
+		return SessionResultJSON{}, false
+	}
+	if err != nil {
+		file.result.Code = codeOf(err)
+		file.result.Error = err.Error()
+		return SessionResultJSON{}, false
+	}
+
+	s.received += file.info.Size - file.received
+	file.received = file.info.Size
+	file.result = FileResultJSON{Path: rel_path, Status: FileReceived, SavedAs: saved_as}
+	s.files_done++
+
+	if s.files_done == len(s.files) && s.result == nil {
+		s.complete(nil)
+		return *s.result, true
+	}
+	return SessionResultJSON{}, false
+}
+
+// end waits for the files still being received and completes the session, if
+// it isn't complete already. `sender_err` is why the sender ended it early.
+func (s *session) end(sender_err error) SessionResultJSON {
+	timer := time.AfterFunc(SESSION_END_TIMEOUT, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.timed_out = true
+		s.idle.Broadcast()
+	})
+	defer timer.Stop()
+
+	s.mu.Lock()
+	for s.active > 0 && !s.timed_out {
+		s.idle.Wait()
+	}
+	completed := s.result == nil
+	if completed {
+		s.complete(sender_err)
+	}
+	result := *s.result
+	s.mu.Unlock()
+
+	if completed {
+		s.notify(result)
+	}
+	return result
+}
+
+// complete settles the result of every file, the caller must hold `mu` and
+// notify on_complete once it doesn't anymore.
+func (s *session) complete(sender_err error) {
+	result := SessionResultJSON{Session: s.id, Peer: s.offer.Peer, SenderCode: codeOf(sender_err)}
+	if sender_err != nil {
+		result.SenderError = sender_err.Error()
+	}
+	for _, file_info := range s.offer.Files {
+		file_result := s.files[file_info.relPath()].result
+		if file_result.Status != FileReceived {
+			file_result.Status = FileFailed
+			if file_result.Error == "" {
+				file_result.Code = CodeCancelled
+				file_result.Error = "not received"
+			}
+		}
+		result.Files = append(result.Files, file_result)
+	}
+	s.result = &result
+
+	s.report()
+	failed := result.Failed()
+	for _, file_result := range failed {
+		log.Warn("Session %s: `%s` failed: %s", s.id, file_result.Path, file_result.Error)
+	}
+	log.Info("Session %s complete: %d of %d entries received", s.id, len(result.Files)-len(failed), len(result.Files))
+}
+
+// notify hands the result to on_complete. It is called without `mu`, so the
+// callback can use the session and the Listener.
+func (s *session) notify(result SessionResultJSON) {
+	if s.on_complete != nil {
+		s.on_complete(result)
+	}
+}
+
+// replyEndSession ends the session the sender is done with and tells it the outcome.
+func (conn *Conn) replyEndSession(l *Listener, request_header RequestHeader) error {
+	sess, err := l.getSession(conn, request_header)
+	if err != nil {
+		return err
+	}
+	end, err := receiveMessage[EndSessionJSON](conn)
+	if err != nil {
+		return err
+	}
+	sender_err := remoteError(end.Code, end.Error)
+	if sender_err != nil {
+		log.Warn("Session %s: the sender stopped: %s", sess.id, sender_err)
+	}
+
+	result := sess.end(sender_err)
+	l.sessions.Remove(sess.id)
+	sess.mu.Lock()
+	sess.expiry.Stop()
+	sess.mu.Unlock()
+
+	_, err = conn.sendMessage(result)
+	return err
+}
+
+// endSession tells the receiver the session is over, `send_err` is why it
+// ended early, and returns the outcome.
+func (fs *Sender) endSession(send_err error) (SessionResultJSON, error) {
+	conn, err := fs.connect()
+	if err != nil {
+		return SessionResultJSON{}, err
+	}
+	defer conn.Close()
+
+	end := EndSessionJSON{Code: codeOf(send_err)}
+	if send_err != nil {
+		end.Error = send_err.Error()
+	}
+	_, err = conn.SendMessage(end, fs.requestHeader(uuid.New(), RequestEndSession))
+	if err != nil {
+		return SessionResultJSON{}, err
+	}
+
+	result, err := receiveMessage[SessionResultJSON](conn)
+	if err != nil {
+		return SessionResultJSON{}, fmt.Errorf("On session result: %w", err)
+	}
+	return result, conn.receiveStatus()
+}
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSessionComplete ends sessions every way they can end, with a callback
+// that uses the session.
+func TestSessionComplete(t *testing.T) {
+	offer := func(fs *Sender) error {
+		var err error
+		fs.session, err = fs.sendOffer([]FileInfoJSON{{Name: "a.bin", Path: "a.bin", Size: 1000}})
+		return err
+	}
+	tests := []struct {
+		name string
+		end  func(l *Listener, fs *Sender, file_path string) error
+		want FileStatus
+	}{
+		{"every file received", func(l *Listener, fs *Sender, file_path string) error {
+			return fs.SendFiles([]string{file_path})
+		}, FileReceived},
+		{"ended by the sender", func(l *Listener, fs *Sender, file_path string) error {
+			err := offer(fs)
+			if err != nil {
+				return err
+			}
+			_, err = fs.endSession(errors.New("stopped"))
+			return err
+		}, FileFailed},
+		{"expired", func(l *Listener, fs *Sender, file_path string) error {
+			err := offer(fs)
+			if err != nil {
+				return err
+			}
+			sess, _ := l.sessions.Get(fs.session)
+			sess.mu.Lock()
+			sess.last_used = time.Now().Add(-SESSION_IDLE_TIMEOUT)
+			sess.mu.Unlock()
+			l.expire(sess)
+			if l.sessions.Has(fs.session) {
+				return errors.New("The expired session wasn't removed")
+			}
+			return nil
+		}, FileFailed},
+	}
+
+	file_path := filepath.Join(t.TempDir(), "a.bin")
+	writeRandomFile(t, file_path, 1000, 1)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newTestListener(t)
+			results := make(chan SessionResultJSON, 1)
+			l.SessionComplete = func(result SessionResultJSON) {
+				sess, ok := l.sessions.Get(result.Session)
+				if ok {
+					sess.touch()
+				}
+				results <- result
+			}
+			fs := NewTransportFileSender(serveMemory(t, l), TEST_ADDRESS)
+			defer fs.Close()
+
+			done := make(chan error, 1)
+			go func() { done <- test.end(l, fs, file_path) }()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("The session never ended")
+			}
+			result := <-results
+			if len(result.Files) != 1 || result.Files[0].Status != test.want {
+				t.Fatalf("Got %+v, want one file %s", result.Files, test.want)
+			}
+		})
+	}
+}
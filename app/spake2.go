@@ -0,0 +1,168 @@
+package app
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"filippo.io/edwards25519"
+)
+
+var (
+	ErrInvalidPakeMessage = errors.New("Invalid key exchange message")
+	ErrPakeConfirmation   = errors.New("Key exchange confirmation doesn't match, wrong code")
+)
+
+// SPAKE2 over edwards25519. Both sides blind their key share with the pairing
+// code, so only someone who knows the code ends up with the same key, and a
+// wrong guess costs an attacker a whole connection.
+//
+// M and N are points nobody knows the discrete log of, they are derived by
+// hashing a label until it decodes to a point.
+var (
+	spake2_m = hashToPoint("BigDownloadP2P SPAKE2 M")
+	spake2_n = hashToPoint("BigDownloadP2P SPAKE2 N")
+)
+
+const (
+	pake_sender_id   = "BigDownloadP2P sender"
+	pake_receiver_id = "BigDownloadP2P receiver"
+)
+
+func hashToPoint(label string) *edwards25519.Point {
+	for counter := uint32(0); ; counter++ {
+		h := sha256.New()
+		h.Write([]byte(label))
+		binary.Write(h, binary.BigEndian, counter)
+
+		point, err := new(edwards25519.Point).SetBytes(h.Sum(nil))
+		if err != nil {
+			continue
+		}
+		point.MultByCofactor(point)
+		if point.Equal(edwards25519.NewIdentityPoint()) == 1 {
+			continue
+		}
+		return point
+	}
+}
+
+func randomScalar() (*edwards25519.Scalar, error) {
+	seed := make([]byte, 64)
+	_, err := rand.Read(seed)
+	if err != nil {
+		return nil, fmt.Errorf("On random scalar: %w", err)
+	}
+	return edwards25519.NewScalar().SetUniformBytes(seed)
+}
+
+func passwordScalar(code string) *edwards25519.Scalar {
+	sum := sha512.Sum512([]byte("BigDownloadP2P pairing code\x00" + code))
+	w, _ := edwards25519.NewScalar().SetUniformBytes(sum[:])
+	return w
+}
+
+// spake2 is one side of the exchange. The sender blinds with M, the receiver with N.
+type spake2 struct {
+	is_sender bool
+	w         *edwards25519.Scalar
+	secret    *edwards25519.Scalar
+	message   []byte
+}
+
+func newSpake2(code string, is_sender bool) (*spake2, error) {
+	secret, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+	w := passwordScalar(code)
+
+	blind := spake2_n
+	if is_sender {
+		blind = spake2_m
+	}
+	share := new(edwards25519.Point).ScalarBaseMult(secret)
+	share.Add(share, new(edwards25519.Point).ScalarMult(w, blind))
+
+	return &spake2{is_sender: is_sender, w: w, secret: secret, message: share.Bytes()}, nil
+}
+
+// pakeKeys are what both sides share after the exchange.
+type pakeKeys struct {
+	sender_confirm   []byte
+	receiver_confirm []byte
+	sender_key       []byte
+	receiver_key     []byte
+	transcript       []byte
+}
+
+// finish combines the peer's message with ours into the shared keys.
+func (s *spake2) finish(peer_message []byte) (pakeKeys, error) {
+	peer_share, err := new(edwards25519.Point).SetBytes(peer_message)
+	if err != nil {
+		return pakeKeys{}, fmt.Errorf("%w: %w", ErrInvalidPakeMessage, err)
+	}
+
+	unblind := spake2_m
+	if s.is_sender {
+		unblind = spake2_n
+	}
+	peer_share.Subtract(peer_share, new(edwards25519.Point).ScalarMult(s.w, unblind))
+	shared := new(edwards25519.Point).ScalarMult(s.secret, peer_share)
+	shared.MultByCofactor(shared)
+	if shared.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return pakeKeys{}, fmt.Errorf("%w: low order point", ErrInvalidPakeMessage)
+	}
+
+	sender_message, receiver_message := s.message, peer_message
+	if !s.is_sender {
+		sender_message, receiver_message = peer_message, s.message
+	}
+
+	transcript := sha256.New()
+	for _, field := range [][]byte{[]byte(pake_sender_id), []byte(pake_receiver_id), sender_message, receiver_message, shared.Bytes(), s.w.Bytes()} {
+		binary.Write(transcript, binary.LittleEndian, uint64(len(field)))
+		transcript.Write(field)
+	}
+	transcript_hash := transcript.Sum(nil)
+
+	keys := pakeKeys{transcript: transcript_hash}
+	for _, key := range []struct {
+		info string
+		dst  *[]byte
+	}{
+		{"sender confirm", &keys.sender_confirm},
+		{"receiver confirm", &keys.receiver_confirm},
+		{"sender key", &keys.sender_key},
+		{"receiver key", &keys.receiver_key},
+	} {
+		*key.dst, err = hkdf.Key(sha256.New, transcript_hash, nil, "BigDownloadP2P "+key.info, 32)
+		if err != nil {
+			return pakeKeys{}, fmt.Errorf("On derive key: %w", err)
+		}
+	}
+	return keys, nil
+}
+
+func (pk pakeKeys) confirmation(is_sender bool) []byte {
+	key := pk.receiver_confirm
+	if is_sender {
+		key = pk.sender_confirm
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(pk.transcript)
+	return mac.Sum(nil)
+}
+
+// checkConfirmation checks the confirmation the peer sent.
+func (pk pakeKeys) checkConfirmation(peer_is_sender bool, confirmation []byte) error {
+	if !hmac.Equal(pk.confirmation(peer_is_sender), confirmation) {
+		return ErrPakeConfirmation
+	}
+	return nil
+}
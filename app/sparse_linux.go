@@ -0,0 +1,42 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataExtents returns the ranges of `file` that hold data, everything between
+// them is a hole that reads as zeros.
+func dataExtents(file *os.File, size int64) ([]FileRange, error) {
+	extents := []FileRange{}
+	offset := int64(0)
+	for offset < size {
+		data, err := file.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, syscall.ENXIO) {
+			// Only a hole is left
+			break
+		}
+		if errors.Is(err, syscall.EINVAL) && offset == 0 {
+			// The filesystem can't tell, so it's all data
+			return []FileRange{{Offset: 0, Length: size}}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("On seek data: %w", err)
+		}
+
+		hole, err := file.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, fmt.Errorf("On seek hole: %w", err)
+		}
+		hole = min(hole, size)
+		if hole > data {
+			extents = append(extents, FileRange{Offset: data, Length: hole - data})
+		}
+		offset = hole
+	}
+	return extents, nil
+}
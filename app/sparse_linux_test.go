@@ -0,0 +1,57 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSparseTransfer(t *testing.T) {
+	const size = 16 * MiB
+	tests := []struct {
+		name  string
+		parts int
+	}{
+		{"one part", 1},
+		{"hole across parts", 4},
+	}
+
+	// Data in the first and last chunk, a hole in between
+	file_path := filepath.Join(t.TempDir(), "sparse.bin")
+	writeRandomFile(t, file_path, int(CHUNK_SIZE), 6)
+	file, err := os.OpenFile(file_path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt([]byte("the end"), size-7)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocatedSize(t, file_path) >= size {
+		t.Skip("The filesystem doesn't keep holes")
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newTestListener(t)
+			counted := &cutTransport{Transport: serveMemory(t, l)}
+			fs := NewTransportFileSender(counted, TEST_ADDRESS)
+			fs.Parts = test.parts
+			defer fs.Close()
+
+			err := fs.SendFiles([]string{file_path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			received := filepath.Join(l.DownloadsDir, "sparse.bin")
+			assertSameFile(t, file_path, received)
+			if allocated := allocatedSize(t, received); allocated >= size {
+				t.Fatalf("The received file takes %d bytes of disk, the holes weren't kept", allocated)
+			}
+			if counted.written.Load() >= size/2 {
+				t.Fatalf("Sent %d bytes of a file with %d of data", counted.written.Load(), 2*CHUNK_SIZE)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/NikosGour/logging/src"
+)
+
+// How long the receiver keeps reading what the sender still sends after a
+// request failed, so the sender gets to read the status
+const STATUS_DRAIN_TIMEOUT = 10 * time.Second
+
+var ErrNoHalfClose = errors.New("The connection can't half-close")
+
+// StatusJSON is the last thing the receiver sends for every request.
+type StatusJSON struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (s StatusJSON) err() error {
+	return remoteError(s.Code, s.Message)
+}
+
+// statusOf is the status the receiver replies with when a request returned `err`.
+func statusOf(err error) StatusJSON {
+	if err == nil {
+		return StatusJSON{Code: CodeOK}
+	}
+	return StatusJSON{Code: codeOf(err), Message: err.Error()}
+}
+
+// sendStatus tells the sender how its request turned out. What the sender
+// still sends is drained while the status is sent, a failed request may not
+// have been read in full and closing before the sender half-closes, e.g. with a
+// TLS close_notify, would reset the connection under the status.
+func (conn *Conn) sendStatus(request_err error) {
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		conn.drain(STATUS_DRAIN_TIMEOUT)
+	}()
+	defer func() { <-drained }()
+
+	_, err := conn.sendMessage(statusOf(request_err))
+	if err != nil {
+		log.Warn("Couldn't send the status to `%s`: %s", conn.remoteAddr(), err)
+	}
+}
+
+// drain reads what the sender is still sending until it half-closes, closing
+// with unread data would reset the connection before it reads the status. It
+// gives up after `timeout`, by the read deadline where the connection has one
+// and by closing it either way.
+func (conn *Conn) drain(timeout time.Duration) {
+	deadline_conn, ok := conn.c.(interface{ SetReadDeadline(time.Time) error })
+	if ok {
+		_ = deadline_conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	give_up := time.AfterFunc(timeout, func() { _ = conn.c.Close() })
+	defer give_up.Stop()
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+// receiveStatus half-closes the connection and waits for the receiver to say
+// how the request turned out.
+func (conn *Conn) receiveStatus() error {
+	err := conn.closeWrite()
+	if err != nil {
+		return fmt.Errorf("On close write: %w", err)
+	}
+
+	status, err := receiveMessage[StatusJSON](conn)
+	if err != nil {
+		return fmt.Errorf("On status: %w", err)
+	}
+	return status.err()
+}
+
+// closeWrite tells the peer nothing more is coming. Every request relies on
+// it, so a connection that can't half-close is an error.
+func (conn *Conn) closeWrite() error {
+	write_closer, ok := conn.c.(interface{ CloseWrite() error })
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrNoHalfClose, conn.c)
+	}
+	return write_closer.CloseWrite()
+}
@@ -0,0 +1,84 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stuckConn is a connection whose reads wait until it is closed, without
+// deadlines or a half-close.
+type stuckConn struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newStuckConn() *stuckConn {
+	return &stuckConn{closed: make(chan struct{})}
+}
+
+func (sc *stuckConn) Read(p []byte) (int, error) {
+	<-sc.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (sc *stuckConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (sc *stuckConn) Close() error {
+	sc.once.Do(func() { close(sc.closed) })
+	return nil
+}
+
+func TestDrainGivesUp(t *testing.T) {
+	memory := func() io.ReadWriteCloser {
+		transport := NewMemoryTransport()
+		ln, err := transport.Listen(TEST_ADDRESS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go ln.Accept()
+		conn, err := transport.Dial(TEST_ADDRESS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	tests := []struct {
+		name string
+		conn func() io.ReadWriteCloser
+	}{
+		{"no deadline", func() io.ReadWriteCloser { return newStuckConn() }},
+		{"paired", func() io.ReadWriteCloser { return &pairedConn{Conn: memory().(net.Conn)} }},
+		{"deadline", memory},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := NewConn(test.conn())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				conn.drain(50 * time.Millisecond)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("The drain never gave up")
+			}
+		})
+	}
+}
+
+func TestCloseWriteUnsupported(t *testing.T) {
+	for _, c := range []io.ReadWriteCloser{newStuckConn(), &pairedConn{Conn: nil}} {
+		err := NewConn(c).closeWrite()
+		if !errors.Is(err, ErrNoHalfClose) {
+			t.Errorf("%T: got %v, want %v", c, err, ErrNoHalfClose)
+		}
+	}
+}
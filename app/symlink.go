@@ -0,0 +1,126 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrUnknownSymlinkPolicy = errors.New("Unknown symlink policy")
+	ErrSymlinkEscapesRoot   = errors.New("Symlink target escapes the downloads dir")
+	ErrPathThroughSymlink   = errors.New("Path goes through a symlink")
+)
+
+// SymlinkPolicy is what happens to the symlinks found in a tree being sent.
+type SymlinkPolicy string
+
+const (
+	SymlinkPreserve SymlinkPolicy = "preserve"
+	SymlinkFollow   SymlinkPolicy = "follow"
+	SymlinkSkip     SymlinkPolicy = "skip"
+
+	DEFAULT_SYMLINK_POLICY = SymlinkPreserve
+)
+
+func ParseSymlinkPolicy(name string) (SymlinkPolicy, error) {
+	switch policy := SymlinkPolicy(name); policy {
+	case SymlinkPreserve, SymlinkFollow, SymlinkSkip:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("%w: `%s`", ErrUnknownSymlinkPolicy, name)
+	}
+}
+
+// validateLinkTarget makes sure the link at `rel_path` points somewhere inside
+// the downloads dir. Targets are relative and slash separated.
+func validateLinkTarget(rel_path string, target string) error {
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(filepath.FromSlash(target)) {
+		return fmt.Errorf("%w: `%s` -> `%s`", ErrSymlinkEscapesRoot, rel_path, target)
+	}
+
+	resolved := path.Join(path.Dir(rel_path), target)
+	if !filepath.IsLocal(filepath.FromSlash(resolved)) {
+		return fmt.Errorf("%w: `%s` -> `%s`", ErrSymlinkEscapesRoot, rel_path, target)
+	}
+
+	// `..` after a name goes up from wherever the name leads, and if it is a
+	// link that isn't where the text says. Leading ones go up from the dir of
+	// the link, which is never a link itself.
+	went_down := false
+	for _, name := range strings.Split(target, "/") {
+		switch {
+		case name == ".." && went_down:
+			return fmt.Errorf("%w: `%s` -> `%s`", ErrSymlinkEscapesRoot, rel_path, target)
+		case name != ".." && name != "." && name != "":
+			went_down = true
+		}
+	}
+	return nil
+}
+
+// confinedDir makes the dir `rel_dir` under `root` and returns its name. Every
+// dir on the way must be a real dir, a symlink a peer sent earlier could lead
+// out of `root` whatever its target reads.
+func confinedDir(root string, rel_dir string) (string, error) {
+	dir_name := root
+	rel_dir = path.Clean(rel_dir)
+	if rel_dir != "." {
+		for _, name := range strings.Split(rel_dir, "/") {
+			dir_name = filepath.Join(dir_name, name)
+			err := os.Mkdir(dir_name, os.ModeDir|os.ModePerm)
+			if err != nil && !os.IsExist(err) {
+				return "", fmt.Errorf("On Mkdir: %w", err)
+			}
+
+			dir_info, err := os.Lstat(dir_name)
+			if err != nil {
+				return "", fmt.Errorf("On Lstat: %w", err)
+			}
+			if dir_info.Mode()&os.ModeSymlink != 0 {
+				return "", fmt.Errorf("%w: `%s`", ErrPathThroughSymlink, rel_dir)
+			}
+			if !dir_info.IsDir() {
+				return "", fmt.Errorf("%w: `%s` isn't a directory", ErrInvalidFilePath, path.Join(rel_dir, name))
+			}
+		}
+	}
+
+	// Check where it really is, in case anything changed under us
+	real_root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("On EvalSymlinks: %w", err)
+	}
+	real_dir, err := filepath.EvalSymlinks(dir_name)
+	if err != nil {
+		return "", fmt.Errorf("On EvalSymlinks: %w", err)
+	}
+	rel, err := filepath.Rel(real_root, real_dir)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%w: `%s` is at `%s`", ErrPathThroughSymlink, rel_dir, real_dir)
+	}
+	return dir_name, nil
+}
+
+// makeSymlink creates the link at `rel_path` under `root` and returns its name,
+// an identical link that is already there is left alone.
+func makeSymlink(root string, rel_path string, target string) (string, error) {
+	dir_name, err := confinedDir(root, path.Dir(rel_path))
+	if err != nil {
+		return "", err
+	}
+	link_name := filepath.Join(dir_name, path.Base(rel_path))
+
+	existing, err := os.Readlink(link_name)
+	if err == nil && existing == target {
+		return link_name, nil
+	}
+	err = os.Symlink(target, link_name)
+	if err != nil {
+		return "", fmt.Errorf("On symlink: %w", err)
+	}
+	return link_name, nil
+}
@@ -0,0 +1,173 @@
+package app
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateLinkTarget(t *testing.T) {
+	tests := []struct {
+		path   string
+		target string
+		want   error
+	}{
+		{"a/link", "b", nil},
+		{"a/link", "../b/c", nil},
+		{"r/d/up2", "../..", nil},
+		{"link", "..", ErrSymlinkEscapesRoot},
+		{"link", "/etc/passwd", ErrSymlinkEscapesRoot},
+		{"link", "", ErrSymlinkEscapesRoot},
+		{"a/link", "../../b", ErrSymlinkEscapesRoot},
+		// Text that stays inside, but `..` after a name that may be a link
+		{"top", "r/d/up2/..", ErrSymlinkEscapesRoot},
+		{"a/link", "../x/../y", ErrSymlinkEscapesRoot},
+	}
+	for _, test := range tests {
+		err := validateLinkTarget(test.path, test.target)
+		if !errors.Is(err, test.want) {
+			t.Errorf("`%s` -> `%s`: got %v, want %v", test.path, test.target, err, test.want)
+		}
+	}
+}
+
+func TestSymlinkPolicy(t *testing.T) {
+	tests := []struct {
+		policy SymlinkPolicy
+		assert func(t *testing.T, tree string, received string)
+	}{
+		{SymlinkPreserve, func(t *testing.T, tree string, received string) {
+			target, err := os.Readlink(filepath.Join(received, "sub", "link"))
+			if err != nil || target != "../a.bin" {
+				t.Fatalf("Symlink not received: `%s`, %v", target, err)
+			}
+		}},
+		{SymlinkFollow, func(t *testing.T, tree string, received string) {
+			assertSameFile(t, filepath.Join(tree, "a.bin"), filepath.Join(received, "sub", "link"))
+			link_info, err := os.Lstat(filepath.Join(received, "sub", "link"))
+			if err != nil || !link_info.Mode().IsRegular() {
+				t.Fatalf("Symlink not followed: %v", err)
+			}
+		}},
+		{SymlinkSkip, func(t *testing.T, tree string, received string) {
+			_, err := os.Lstat(filepath.Join(received, "sub", "link"))
+			if !os.IsNotExist(err) {
+				t.Fatalf("Symlink not skipped: %v", err)
+			}
+		}},
+	}
+
+	tree := makeTestTree(t)
+	err := os.Symlink("../a.bin", filepath.Join(tree, "sub", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			l := newTestListener(t)
+			fs := NewTransportFileSender(serveMemory(t, l), TEST_ADDRESS)
+			fs.Symlinks = test.policy
+			defer fs.Close()
+
+			err := fs.SendFiles([]string{tree})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertTestTree(t, tree, l.DownloadsDir)
+			test.assert(t, tree, filepath.Join(l.DownloadsDir, "tree"))
+		})
+	}
+}
+
+func TestSymlinkChainRejected(t *testing.T) {
+	l := newTestListener(t)
+	transport := serveMemory(t, l)
+
+	links := []FileInfoJSON{
+		{Name: "up2", Path: "r/d/up2", LinkTarget: "../.."},
+		{Name: "top", Path: "top", LinkTarget: "r/d/up2/.."},
+	}
+	reply, err := sendRawOffer(t, transport, links)
+	if err != nil || !reply.Accepted {
+		t.Fatalf("Offer: %v, %s", err, reply.Reason)
+	}
+
+	err = sendRaw(t, transport, links[0], RequestMakeSymlink, reply.Session)
+	if err != nil {
+		t.Fatalf("`%s`: %s", links[0].Path, err)
+	}
+	err = sendRaw(t, transport, links[1], RequestMakeSymlink, reply.Session)
+	if !errors.Is(err, ErrInvalidMetadata) {
+		t.Fatalf("`%s`: got %v, want %v", links[1].Path, err, ErrInvalidMetadata)
+	}
+	_, err = os.Lstat(filepath.Join(l.DownloadsDir, "top"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("`top` was created: %v", err)
+	}
+}
+
+// TestSymlinkEscape sends a tree into a downloads dir that already has links out
+// of it, whatever got them there nothing may be written through them.
+func TestSymlinkEscape(t *testing.T) {
+	tests := []struct {
+		name  string
+		links map[string]string
+		tree  []string
+	}{
+		{"file through a link", map[string]string{"top": ".."}, []string{"top/pwned.bin"}},
+		{"file through chained links", map[string]string{"r/d/up2": "../..", "top": "r/d/up2/.."}, []string{"top/pwned.bin"}},
+		{"file deep through a link", map[string]string{"top": ".."}, []string{"top/sub/pwned.bin"}},
+		{"dir through a link", map[string]string{"top": ".."}, []string{"top/sub/"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parent := t.TempDir()
+			downloads_dir := filepath.Join(parent, "downloads")
+			err := os.Mkdir(downloads_dir, 0777)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for link, target := range test.links {
+				link_name := filepath.Join(downloads_dir, link)
+				err = os.MkdirAll(filepath.Dir(link_name), 0777)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.Symlink(target, link_name)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			src := t.TempDir()
+			for _, name := range test.tree {
+				if name[len(name)-1] == '/' {
+					err = os.MkdirAll(filepath.Join(src, name), 0777)
+					if err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				writeRandomFile(t, filepath.Join(src, name), 100, 1)
+			}
+
+			l := NewListener(0, downloads_dir)
+			l.AutoAccept = true
+			fs := NewTransportFileSender(serveMemory(t, l), TEST_ADDRESS)
+			defer fs.Close()
+			err = fs.SendFiles([]string{filepath.Join(src, "top")})
+			if err == nil {
+				t.Fatal("Sent through a link out of the downloads dir")
+			}
+
+			for _, name := range []string{"pwned.bin", "sub"} {
+				_, err = os.Lstat(filepath.Join(parent, name))
+				if !os.IsNotExist(err) {
+					t.Fatalf("`%s` escaped the downloads dir: %v", name, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package app
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/NikosGour/logging/src"
+)
+
+var (
+	ErrPeerFingerprintMismatch = errors.New("Peer fingerprint doesn't match")
+	ErrNoPeerCertificate       = errors.New("Peer sent no certificate")
+	ErrInvalidKnownPeers       = errors.New("Invalid known peers file")
+)
+
+const (
+	IDENTITY_CERT_FILE = "identity.crt"
+	IDENTITY_KEY_FILE  = "identity.key"
+	KNOWN_PEERS_FILE   = "known_peers"
+
+	IDENTITY_VALIDITY = 10 * 365 * 24 * time.Hour
+)
+
+// DefaultConfigDir is where the identity and the known peers are kept.
+func DefaultConfigDir() (string, error) {
+	config_dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("On user config dir: %w", err)
+	}
+	return filepath.Join(config_dir, "BigDownloadP2P"), nil
+}
+
+// Identity is the self-signed certificate a node presents over TLS. It is
+// generated once and kept, so peers can pin its fingerprint.
+type Identity struct {
+	Certificate tls.Certificate
+	Fingerprint string
+}
+
+// LoadOrCreateIdentity loads the identity kept in `dir`, creating it on first use.
+func LoadOrCreateIdentity(dir string) (*Identity, error) {
+	cert_path := filepath.Join(dir, IDENTITY_CERT_FILE)
+	key_path := filepath.Join(dir, IDENTITY_KEY_FILE)
+
+	_, err := os.Stat(cert_path)
+	if os.IsNotExist(err) {
+		err = createIdentity(cert_path, key_path)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("On Stat: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(cert_path, key_path)
+	if err != nil {
+		return nil, fmt.Errorf("On load identity: %w", err)
+	}
+	return &Identity{Certificate: cert, Fingerprint: Fingerprint(cert.Certificate[0])}, nil
+}
+
+func createIdentity(cert_path string, key_path string) error {
+	cert_der, key, err := newCertificate(IDENTITY_VALIDITY)
+	if err != nil {
+		return err
+	}
+	key_der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("On marshal key: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(cert_path), 0700)
+	if err != nil {
+		return fmt.Errorf("On MkdirAll: %w", err)
+	}
+	err = os.WriteFile(key_path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key_der}), 0600)
+	if err != nil {
+		return fmt.Errorf("On write key: %w", err)
+	}
+	err = os.WriteFile(cert_path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert_der}), 0644)
+	if err != nil {
+		return fmt.Errorf("On write certificate: %w", err)
+	}
+	log.Info("Created a new identity in `%s`", filepath.Dir(cert_path))
+	return nil
+}
+
+// newCertificate creates a self-signed certificate valid for `validity`.
+func newCertificate(validity time.Duration) ([]byte, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("On generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("On serial number: %w", err)
+	}
+	host_name, _ := os.Hostname()
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "BigDownloadP2P " + host_name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	cert_der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("On create certificate: %w", err)
+	}
+	return cert_der, key, nil
+}
+
+// Fingerprint returns the SHA256 fingerprint of a certificate, in the style of ssh.
+func Fingerprint(cert_der []byte) string {
+	sum := sha256.Sum256(cert_der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// serverTLSConfig asks senders for their certificate but doesn't verify it,
+// it only identifies them.
+func (id *Identity) serverTLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{id.Certificate},
+		ClientAuth:   tls.RequestClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}
+}
+
+// clientTLSConfig trusts the receiver at `addr` by its fingerprint alone,
+// self-signed certificates can't be verified any other way. A `pinned`
+// fingerprint has to match as well as the known one.
+func (id *Identity) clientTLSConfig(addr string, known_peers *KnownPeers, pinned string) *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{id.Certificate},
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return ErrNoPeerCertificate
+			}
+			fingerprint := Fingerprint(state.PeerCertificates[0].Raw)
+			if pinned != "" && fingerprint != pinned {
+				return fmt.Errorf("%w: `%s` is %s, expected %s", ErrPeerFingerprintMismatch, addr, fingerprint, pinned)
+			}
+			if known_peers == nil {
+				return nil
+			}
+			return known_peers.verify(addr, fingerprint)
+		},
+	}
+}
+
+// KnownPeers are the fingerprints of the receivers seen so far, by address.
+// A new peer is trusted on first use, a peer whose fingerprint changed isn't.
+type KnownPeers struct {
+	path  string
+	peers map[string]string
+	mu    sync.Mutex
+}
+
+// LoadKnownPeers reads the known peers file, which has an `address fingerprint`
+// pair on every line.
+func LoadKnownPeers(path string) (*KnownPeers, error) {
+	kp := &KnownPeers{path: path, peers: map[string]string{}}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return kp, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("On open known peers: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line_num := 1; scanner.Scan(); line_num++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%w: `%s` line %d", ErrInvalidKnownPeers, path, line_num)
+		}
+		kp.peers[fields[0]] = fields[1]
+	}
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("On read known peers: %w", scanner.Err())
+	}
+	return kp, nil
+}
+
+func (kp *KnownPeers) verify(addr string, fingerprint string) error {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	known, ok := kp.peers[addr]
+	if ok {
+		if known != fingerprint {
+			return fmt.Errorf("%w: `%s` is %s, known as %s in `%s`", ErrPeerFingerprintMismatch, addr, fingerprint, known, kp.path)
+		}
+		return nil
+	}
+
+	log.Warn("Trusting new peer `%s` with fingerprint %s", addr, fingerprint)
+	kp.peers[addr] = fingerprint
+	return kp.save(addr, fingerprint)
+}
+
+// save appends a newly trusted peer, the caller must hold `mu`.
+func (kp *KnownPeers) save(addr string, fingerprint string) error {
+	err := os.MkdirAll(filepath.Dir(kp.path), 0700)
+	if err != nil {
+		return fmt.Errorf("On MkdirAll: %w", err)
+	}
+	file, err := os.OpenFile(kp.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("On open known peers: %w", err)
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%s %s\n", addr, fingerprint)
+	if err != nil {
+		return fmt.Errorf("On write known peers: %w", err)
+	}
+	return nil
+}
+
+// serveTLS secures the connection with TLS from the receiver's side.
+func (conn *Conn) serveTLS(id *Identity) error {
+	net_conn, ok := conn.c.(net.Conn)
+	if !ok {
+		return fmt.Errorf("On TLS: %T isn't a network connection", conn.c)
+	}
+	tls_conn := tls.Server(net_conn, id.serverTLSConfig())
+	err := tls_conn.Handshake()
+	if err != nil {
+		return fmt.Errorf("On TLS handshake: %w", err)
+	}
+	conn.c = tls_conn
+	conn.tls_conn = tls_conn
+	return nil
+}
+
+// peerFingerprint returns the fingerprint of the certificate the peer sent,
+// or "" when the connection isn't over TLS or the peer sent none.
+func (conn *Conn) peerFingerprint() string {
+	if conn.carrier != nil {
+		return conn.carrier.peerFingerprint()
+	}
+	tls_conn := conn.tls_conn
+	if tls_conn == nil {
+		return ""
+	}
+	err := tls_conn.Handshake()
+	if err != nil {
+		return ""
+	}
+	certs := tls_conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return Fingerprint(certs[0].Raw)
+}
@@ -0,0 +1,512 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const TEST_ADDRESS = "receiver"
+
+// serve runs `l` on `transport` at `address` until the test ends.
+func serve(t *testing.T, l *Listener, transport Transport, address string) {
+	t.Helper()
+	ln, err := transport.Listen(address)
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- l.Serve(ln) }()
+	t.Cleanup(func() {
+		ln.Close()
+		err := <-done
+		if err != nil {
+			t.Errorf("Serve: %s", err)
+		}
+	})
+}
+
+// serveMemory runs `l` on a new MemoryTransport, senders reach it at TEST_ADDRESS.
+func serveMemory(t *testing.T, l *Listener) *MemoryTransport {
+	t.Helper()
+	transport := NewMemoryTransport()
+	serve(t, l, transport, TEST_ADDRESS)
+	return transport
+}
+
+func newTestListener(t *testing.T) *Listener {
+	l := NewListener(0, t.TempDir())
+	l.AutoAccept = true
+	return l
+}
+
+func writeRandomFile(t *testing.T, file_path string, size int, seed int64) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	err := os.MkdirAll(filepath.Dir(file_path), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(file_path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertSameFile(t *testing.T, want string, got string) {
+	t.Helper()
+	want_data, err := os.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got_data, err := os.ReadFile(got)
+	if err != nil {
+		t.Fatalf("Not received: %s", err)
+	}
+	if !bytes.Equal(want_data, got_data) {
+		t.Fatalf("`%s` differs from `%s`", got, want)
+	}
+}
+
+// sendRaw sends `message` as a request of `request_type`, without the checks a
+// Sender makes, and returns the receiver's status.
+func sendRaw(t *testing.T, transport Transport, message any, request_type RequestType, session UUID) error {
+	t.Helper()
+	fs := NewTransportFileSender(transport, TEST_ADDRESS)
+	conn, err := fs.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.SendMessage(message, RequestHeader{UUID: uuid.New(), RequestType: request_type, Session: session})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.receiveStatus()
+}
+
+// sendRawOffer offers `files` as they are, without the checks a Sender makes.
+func sendRawOffer(t *testing.T, transport Transport, files []FileInfoJSON) (OfferReplyJSON, error) {
+	t.Helper()
+	fs := NewTransportFileSender(transport, TEST_ADDRESS)
+	conn, err := fs.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.SendMessage(OfferJSON{Name: "test", Files: files}, RequestHeader{UUID: uuid.New(), RequestType: RequestOffer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := receiveMessage[OfferReplyJSON](conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply, conn.receiveStatus()
+}
+
+func newTestIdentity(t *testing.T) *Identity {
+	t.Helper()
+	identity, err := LoadOrCreateIdentity(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func newTestPairingCode(t *testing.T) string {
+	t.Helper()
+	code, err := NewPairingCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// TestTransfer sends a file in parts with every combination of options that
+// changes how the parts travel.
+func TestTransfer(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, l *Listener, fs *Sender)
+		want  error
+	}{
+		{"plain", nil, nil},
+		{"blake3", func(t *testing.T, l *Listener, fs *Sender) {
+			fs.HashAlgorithm = HashBLAKE3
+		}, nil},
+		{"xxh64", func(t *testing.T, l *Listener, fs *Sender) {
+			fs.HashAlgorithm = HashXXH64
+		}, nil},
+		{"zstd", func(t *testing.T, l *Listener, fs *Sender) {
+			fs.Compression = CompressionZstd
+		}, nil},
+		{"gzip", func(t *testing.T, l *Listener, fs *Sender) {
+			fs.Compression = CompressionGzip
+			fs.CompressionLevel = 9
+		}, nil},
+		{"tls", func(t *testing.T, l *Listener, fs *Sender) {
+			l.Identity = newTestIdentity(t)
+			fs.Identity = newTestIdentity(t)
+			fs.Fingerprint = l.Identity.Fingerprint
+		}, nil},
+		{"tls with the wrong fingerprint", func(t *testing.T, l *Listener, fs *Sender) {
+			l.Identity = newTestIdentity(t)
+			fs.Identity = newTestIdentity(t)
+			fs.Fingerprint = fs.Identity.Fingerprint
+		}, ErrPeerFingerprintMismatch},
+		{"pairing", func(t *testing.T, l *Listener, fs *Sender) {
+			l.PairingCode = newTestPairingCode(t)
+			fs.PairingCode = l.PairingCode
+		}, nil},
+		{"pairing with tls", func(t *testing.T, l *Listener, fs *Sender) {
+			l.Identity = newTestIdentity(t)
+			fs.Identity = newTestIdentity(t)
+			l.PairingCode = newTestPairingCode(t)
+			fs.PairingCode = l.PairingCode
+		}, nil},
+		{"wrong pairing code", func(t *testing.T, l *Listener, fs *Sender) {
+			l.PairingCode = newTestPairingCode(t)
+			fs.PairingCode = newTestPairingCode(t)
+		}, ErrPakeConfirmation},
+		{"pre-shared key", func(t *testing.T, l *Listener, fs *Sender) {
+			l.PreSharedKey = []byte("secret")
+			fs.PreSharedKey = []byte("secret")
+		}, nil},
+		{"wrong pre-shared key", func(t *testing.T, l *Listener, fs *Sender) {
+			l.PreSharedKey = []byte("secret")
+			fs.PreSharedKey = []byte("guess")
+		}, ErrAuthenticationFailed},
+		{"no pre-shared key", func(t *testing.T, l *Listener, fs *Sender) {
+			l.PreSharedKey = []byte("secret")
+		}, ErrIncompatiblePeer},
+		{"json frames", func(t *testing.T, l *Listener, fs *Sender) {
+			l.JSONFrames = true
+			fs.JSONFrames = true
+		}, nil},
+		{"multiplexed", func(t *testing.T, l *Listener, fs *Sender) {
+			fs.Multiplex = true
+		}, nil},
+		{"multiplexed with a pre-shared key", func(t *testing.T, l *Listener, fs *Sender) {
+			l.PreSharedKey = []byte("secret")
+			fs.PreSharedKey = []byte("secret")
+			fs.Multiplex = true
+		}, nil},
+		{"multiplexed over tls", func(t *testing.T, l *Listener, fs *Sender) {
+			l.Identity = newTestIdentity(t)
+			fs.Identity = newTestIdentity(t)
+			fs.Fingerprint = l.Identity.Fingerprint
+			fs.Multiplex = true
+		}, nil},
+	}
+
+	// Random data and then text, so some parts compress and some don't
+	file_path := filepath.Join(t.TempDir(), "a.bin")
+	writeRandomFile(t, file_path, 2*int(MiB)+7, 1)
+	file, err := os.OpenFile(file_path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write(bytes.Repeat([]byte("all work and no play "), int(MiB)/21))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newTestListener(t)
+			results := make(chan SessionResultJSON, 1)
+			l.SessionComplete = func(result SessionResultJSON) { results <- result }
+			fs := NewTransportFileSender(nil, TEST_ADDRESS)
+			fs.Parts = 3
+			if test.setup != nil {
+				test.setup(t, l, fs)
+			}
+			fs.Transport = serveMemory(t, l)
+			defer fs.Close()
+
+			err := fs.SendFiles([]string{file_path})
+			if test.want != nil {
+				if !errors.Is(err, test.want) {
+					t.Fatalf("Got %v, want %v", err, test.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSameFile(t, file_path, filepath.Join(l.DownloadsDir, "a.bin"))
+			if failed := (<-results).Failed(); len(failed) > 0 {
+				t.Fatalf("Failed: %v", failed)
+			}
+		})
+	}
+}
+
+// makeTestTree makes a dir with files, an empty file and an empty dir, and
+// returns it.
+func makeTestTree(t *testing.T) string {
+	t.Helper()
+	tree := filepath.Join(t.TempDir(), "tree")
+	writeRandomFile(t, filepath.Join(tree, "a.bin"), 3*int(MiB)+7, 1)
+	writeRandomFile(t, filepath.Join(tree, "sub", "b.txt"), 1000, 2)
+	writeRandomFile(t, filepath.Join(tree, "sub", "deeper", "empty"), 0, 3)
+	err := os.Mkdir(filepath.Join(tree, "nothing"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func assertTestTree(t *testing.T, tree string, downloads_dir string) {
+	t.Helper()
+	received := filepath.Join(downloads_dir, "tree")
+	for _, name := range []string{"a.bin", "sub/b.txt", "sub/deeper/empty"} {
+		assertSameFile(t, filepath.Join(tree, name), filepath.Join(received, name))
+	}
+	dir_info, err := os.Stat(filepath.Join(received, "nothing"))
+	if err != nil || !dir_info.IsDir() {
+		t.Fatalf("Empty dir not received: %v", err)
+	}
+}
+
+func TestDirTransfer(t *testing.T) {
+	tree := makeTestTree(t)
+	l := newTestListener(t)
+	results := make(chan SessionResultJSON, 1)
+	l.SessionComplete = func(result SessionResultJSON) { results <- result }
+	fs := NewTransportFileSender(serveMemory(t, l), TEST_ADDRESS)
+	defer fs.Close()
+
+	err := fs.SendFiles([]string{tree})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTestTree(t, tree, l.DownloadsDir)
+
+	// tree, nothing, sub, sub/deeper and the three files
+	result := <-results
+	if len(result.Files) != 7 || len(result.Failed()) > 0 {
+		t.Fatalf("Got %d results, %d failed, want 7 received", len(result.Files), len(result.Failed()))
+	}
+}
+
+// TestPreserveMetadata gives the received file the sender's mode and mod time,
+// without the setuid, setgid and sticky bits.
+func TestPreserveMetadata(t *testing.T) {
+	tree := filepath.Join(t.TempDir(), "tree")
+	file_path := filepath.Join(tree, "a.bin")
+	err := os.Mkdir(tree, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRandomFile(t, file_path, 1000, 1)
+	mod_time := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = os.Chmod(file_path, 0o750|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(file_path, mod_time, mod_time)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(tree, 0o710|os.ModeSticky)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The mode of a file the receiver creates on its own
+	probe, err := os.OpenFile(filepath.Join(t.TempDir(), "probe"), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe_info, err := probe.Stat()
+	probe.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		preserve  bool
+		file_mode os.FileMode
+	}{
+		{"preserved", true, 0o750},
+		{"not preserved", false, probe_info.Mode()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newTestListener(t)
+			l.PreserveMetadata = test.preserve
+			fs := NewTransportFileSender(serveMemory(t, l), TEST_ADDRESS)
+			defer fs.Close()
+
+			err := fs.SendFiles([]string{tree})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := os.Stat(filepath.Join(l.DownloadsDir, "tree", "a.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode() != test.file_mode {
+				t.Fatalf("The file's mode is %s, want %s", info.Mode(), test.file_mode)
+			}
+			if info.ModTime().Equal(mod_time) != test.preserve {
+				t.Fatalf("The file's mod time is %s, preserved is %t", info.ModTime(), test.preserve)
+			}
+
+			dir_info, err := os.Stat(filepath.Join(l.DownloadsDir, "tree"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dir_info.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky) != 0 {
+				t.Fatalf("The dir's mode is %s", dir_info.Mode())
+			}
+			if (dir_info.Mode().Perm() == 0o710) != test.preserve {
+				t.Fatalf("The dir's mode is %s, preserved is %t", dir_info.Mode(), test.preserve)
+			}
+		})
+	}
+}
+
+// TestSendString waits for the receiver's answer, which it only sends once the
+// sender half-closed.
+func TestSendString(t *testing.T) {
+	for _, multiplex := range []bool{false, true} {
+		l := newTestListener(t)
+		fs := NewTransportFileSender(serveMemory(t, l), TEST_ADDRESS)
+		fs.Multiplex = multiplex
+
+		done := make(chan error, 1)
+		go func() {
+			conn, err := fs.connect()
+			if err != nil {
+				done <- err
+				return
+			}
+			defer conn.Close()
+			done <- conn.SendString("hello")
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("multiplex=%t: %s", multiplex, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("multiplex=%t: the string was never answered", multiplex)
+		}
+		fs.Close()
+	}
+}
+
+// cutTransport counts what is written to the receiver, and cuts every
+// connection once more than `limit` bytes were written, if it is positive.
+type cutTransport struct {
+	Transport
+	limit   int64
+	written atomic.Int64
+}
+
+func (ct *cutTransport) Dial(address string) (net.Conn, error) {
+	conn, err := ct.Transport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return &cutConn{Conn: conn, transport: ct}, nil
+}
+
+type cutConn struct {
+	net.Conn
+	transport *cutTransport
+}
+
+func (cc *cutConn) Write(p []byte) (int, error) {
+	written := cc.transport.written.Add(int64(len(p)))
+	if cc.transport.limit > 0 && written > cc.transport.limit {
+		cc.Conn.Close()
+		return 0, net.ErrClosed
+	}
+	return cc.Conn.Write(p)
+}
+
+func (cc *cutConn) CloseWrite() error {
+	return cc.Conn.(interface{ CloseWrite() error }).CloseWrite()
+}
+
+// waitForIdleDownloads waits until the receiver noticed the cut and no part is
+// being received anymore.
+func waitForIdleDownloads(t *testing.T, l *Listener) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		idle := true
+		for _, afd := range l.activeFileDownloads.Items() {
+			afd.mu.Lock()
+			for _, active := range afd.active_parts {
+				idle = idle && !active
+			}
+			afd.mu.Unlock()
+		}
+		if idle {
+			return
+		}
+	}
+	t.Fatal("The receiver never noticed the cut")
+}
+
+func TestResumeAfterCut(t *testing.T) {
+	const size = 8 * MiB
+	tests := []struct {
+		name      string
+		multiplex bool
+	}{
+		{"plain", false},
+		{"multiplexed", true},
+	}
+
+	file_path := filepath.Join(t.TempDir(), "big.bin")
+	writeRandomFile(t, file_path, int(size), 4)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newTestListener(t)
+			transport := serveMemory(t, l)
+
+			cut := &cutTransport{Transport: transport, limit: size / 2}
+			fs := NewTransportFileSender(cut, TEST_ADDRESS)
+			fs.Multiplex = test.multiplex
+			fs.Parts = 1
+			err := fs.SendFiles([]string{file_path})
+			fs.Close()
+			if err == nil {
+				t.Fatal("The cut transfer succeeded")
+			}
+			waitForIdleDownloads(t, l)
+
+			counted := &cutTransport{Transport: transport}
+			fs = NewTransportFileSender(counted, TEST_ADDRESS)
+			fs.Multiplex = test.multiplex
+			fs.Parts = 1
+			err = fs.SendFiles([]string{file_path})
+			fs.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSameFile(t, file_path, filepath.Join(l.DownloadsDir, "big.bin"))
+			if counted.written.Load() > size-CHUNK_SIZE {
+				t.Fatalf("Sent %d bytes again of %d, it didn't resume", counted.written.Load(), size)
+			}
+		})
+	}
+}
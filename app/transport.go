@@ -0,0 +1,307 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoListener   = errors.New("Nothing is listening on the address")
+	ErrAddressInUse = errors.New("Address is already in use")
+)
+
+// Transport is how a Sender reaches a Listener. Everything on top of it, TLS,
+// pairing and the protocol itself, only needs a net.Conn.
+type Transport interface {
+	Dial(address string) (net.Conn, error)
+	Listen(address string) (net.Listener, error)
+}
+
+// TCPTransport is the default Transport, addresses are `host:port`.
+type TCPTransport struct{}
+
+func (TCPTransport) Dial(address string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.(*net.TCPConn).SetNoDelay(true)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("On Nagle's: %w", err)
+	}
+	return conn, nil
+}
+
+func (TCPTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+// UnixTransport connects over Unix domain sockets, addresses are socket paths.
+type UnixTransport struct{}
+
+func (UnixTransport) Dial(address string) (net.Conn, error) {
+	return net.Dial("unix", address)
+}
+
+func (UnixTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("unix", address)
+}
+
+// MemoryTransport connects Senders and Listeners of the same process without
+// sockets, addresses are any name a Listener listens on.
+type MemoryTransport struct {
+	listeners map[string]*memoryListener
+	dialed    int
+	mu        sync.Mutex
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{listeners: map[string]*memoryListener{}}
+}
+
+func (mt *MemoryTransport) Dial(address string) (net.Conn, error) {
+	mt.mu.Lock()
+	ml, ok := mt.listeners[address]
+	mt.dialed++
+	// Every dialer is on the same host, like over TCP they differ by port
+	local := memoryAddr(net.JoinHostPort("memory", strconv.Itoa(mt.dialed)))
+	mt.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: `%s`", ErrNoListener, address)
+	}
+
+	to_server, to_client := newMemoryPipe(), newMemoryPipe()
+	client := &memoryConn{in: to_client, out: to_server, local: local, remote: ml.addr}
+	server := &memoryConn{in: to_server, out: to_client, local: ml.addr, remote: local}
+	select {
+	case ml.conns <- server:
+		return client, nil
+	case <-ml.closed:
+		client.Close()
+		server.Close()
+		return nil, fmt.Errorf("%w: `%s`", ErrNoListener, address)
+	}
+}
+
+func (mt *MemoryTransport) Listen(address string) (net.Listener, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if _, ok := mt.listeners[address]; ok {
+		return nil, fmt.Errorf("%w: `%s`", ErrAddressInUse, address)
+	}
+
+	ml := &memoryListener{transport: mt, addr: memoryAddr(address), conns: make(chan net.Conn), closed: make(chan struct{})}
+	mt.listeners[address] = ml
+	return ml, nil
+}
+
+type memoryAddr string
+
+func (ma memoryAddr) Network() string {
+	return "memory"
+}
+
+func (ma memoryAddr) String() string {
+	return string(ma)
+}
+
+// How much a memoryConn holds before writes wait for the peer to read
+const MEMORY_PIPE_SIZE = 64 * KiB
+
+// memoryConn is one end of a pair of pipes, with the addresses of both ends.
+// Like TCP it can half-close, the peer reads io.EOF once it closes its side.
+type memoryConn struct {
+	in     *memoryPipe
+	out    *memoryPipe
+	local  net.Addr
+	remote net.Addr
+}
+
+func (mc *memoryConn) Read(p []byte) (int, error) {
+	return mc.in.read(p)
+}
+
+func (mc *memoryConn) Write(p []byte) (int, error) {
+	return mc.out.write(p)
+}
+
+func (mc *memoryConn) CloseWrite() error {
+	mc.out.closeWrite()
+	return nil
+}
+
+func (mc *memoryConn) Close() error {
+	mc.out.closeWrite()
+	mc.in.closeRead()
+	return nil
+}
+
+func (mc *memoryConn) LocalAddr() net.Addr {
+	return mc.local
+}
+
+func (mc *memoryConn) RemoteAddr() net.Addr {
+	return mc.remote
+}
+
+func (mc *memoryConn) SetDeadline(t time.Time) error {
+	mc.in.setDeadline(&mc.in.read_deadline, t)
+	mc.out.setDeadline(&mc.out.write_deadline, t)
+	return nil
+}
+
+func (mc *memoryConn) SetReadDeadline(t time.Time) error {
+	mc.in.setDeadline(&mc.in.read_deadline, t)
+	return nil
+}
+
+func (mc *memoryConn) SetWriteDeadline(t time.Time) error {
+	mc.out.setDeadline(&mc.out.write_deadline, t)
+	return nil
+}
+
+// memoryPipe carries the bytes of one direction of a memoryConn.
+type memoryPipe struct {
+	buf            []byte
+	write_closed   bool
+	read_closed    bool
+	read_deadline  memoryDeadline
+	write_deadline memoryDeadline
+	mu             sync.Mutex
+	cond           *sync.Cond
+}
+
+type memoryDeadline struct {
+	at    time.Time
+	timer *time.Timer
+}
+
+func (md *memoryDeadline) expired() bool {
+	return !md.at.IsZero() && !time.Now().Before(md.at)
+}
+
+func newMemoryPipe() *memoryPipe {
+	mp := &memoryPipe{}
+	mp.cond = sync.NewCond(&mp.mu)
+	return mp
+}
+
+func (mp *memoryPipe) read(p []byte) (int, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	for len(mp.buf) == 0 && !mp.write_closed && !mp.read_closed && !mp.read_deadline.expired() {
+		mp.cond.Wait()
+	}
+
+	switch {
+	case mp.read_closed:
+		return 0, io.ErrClosedPipe
+	case len(mp.buf) > 0:
+		n := copy(p, mp.buf)
+		mp.buf = mp.buf[n:]
+		mp.cond.Broadcast()
+		return n, nil
+	case mp.write_closed:
+		return 0, io.EOF
+	default:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (mp *memoryPipe) write(p []byte) (int, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	written := 0
+	for written < len(p) {
+		for len(mp.buf) >= int(MEMORY_PIPE_SIZE) && !mp.write_closed && !mp.read_closed && !mp.write_deadline.expired() {
+			mp.cond.Wait()
+		}
+		switch {
+		case mp.write_closed, mp.read_closed:
+			return written, io.ErrClosedPipe
+		case mp.write_deadline.expired():
+			return written, os.ErrDeadlineExceeded
+		}
+
+		n := min(len(p)-written, int(MEMORY_PIPE_SIZE)-len(mp.buf))
+		mp.buf = append(mp.buf, p[written:written+n]...)
+		written += n
+		mp.cond.Broadcast()
+	}
+	return written, nil
+}
+
+// closeWrite ends what the reader gets with io.EOF, after what is buffered.
+func (mp *memoryPipe) closeWrite() {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.write_closed = true
+	mp.cond.Broadcast()
+}
+
+// closeRead drops what is buffered, the writer gets io.ErrClosedPipe.
+func (mp *memoryPipe) closeRead() {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.read_closed = true
+	mp.buf = nil
+	mp.cond.Broadcast()
+}
+
+// setDeadline moves `deadline` to `t`, waking whoever waits on it when it passes.
+func (mp *memoryPipe) setDeadline(deadline *memoryDeadline, t time.Time) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if deadline.timer != nil {
+		deadline.timer.Stop()
+		deadline.timer = nil
+	}
+	deadline.at = t
+	if !t.IsZero() {
+		deadline.timer = time.AfterFunc(time.Until(t), func() {
+			mp.mu.Lock()
+			defer mp.mu.Unlock()
+			mp.cond.Broadcast()
+		})
+	}
+	mp.cond.Broadcast()
+}
+
+type memoryListener struct {
+	transport *MemoryTransport
+	addr      memoryAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	close     sync.Once
+}
+
+func (ml *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ml.conns:
+		return conn, nil
+	case <-ml.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ml *memoryListener) Close() error {
+	ml.close.Do(func() {
+		close(ml.closed)
+		ml.transport.mu.Lock()
+		delete(ml.transport.listeners, string(ml.addr))
+		ml.transport.mu.Unlock()
+	})
+	return nil
+}
+
+func (ml *memoryListener) Addr() net.Addr {
+	return ml.addr
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	transport := NewMemoryTransport()
+	_, err := transport.Dial(TEST_ADDRESS)
+	if !errors.Is(err, ErrNoListener) {
+		t.Fatalf("Dial without a listener: got %v, want %v", err, ErrNoListener)
+	}
+	ln, err := transport.Listen(TEST_ADDRESS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, err = transport.Listen(TEST_ADDRESS)
+	if !errors.Is(err, ErrAddressInUse) {
+		t.Fatalf("Listen twice: got %v, want %v", err, ErrAddressInUse)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := transport.Dial(TEST_ADDRESS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := <-accepted
+	defer server.Close()
+
+	// A read waits until its deadline
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = server.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read past the deadline: got %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	server.SetReadDeadline(time.Time{})
+
+	// More than the pipe holds, then a half-close the server reads as io.EOF
+	data := make([]byte, 3*MEMORY_PIPE_SIZE)
+	go func() {
+		client.Write(data)
+		client.(interface{ CloseWrite() error }).CloseWrite()
+	}()
+	received, err := io.ReadAll(server)
+	if err != nil || len(received) != len(data) {
+		t.Fatalf("Read %d bytes of %d: %v", len(received), len(data), err)
+	}
+
+	// The other direction still works after the half-close
+	_, err = server.Write([]byte("status"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	received, err = io.ReadAll(client)
+	if err != nil || string(received) != "status" {
+		t.Fatalf("Read `%s`: %v", received, err)
+	}
+}
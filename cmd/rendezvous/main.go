@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+
+	"github.com/NikosGour/BigDownloadP2P/app"
+	log "github.com/NikosGour/logging/src"
+)
+
+func main() {
+	const usage = `Usage: rendezvous [OPTIONS]
+Introduces BigDownloadP2P peers behind NATs to each other, it has to be reachable by both.
+Options:
+		-p | --port		The UDP port to listen on (default: 6970)
+		`
+
+	var port int
+	flag.IntVar(&port, "p", app.RENDEZVOUS_PORT, "The UDP port to listen on")
+	flag.IntVar(&port, "port", app.RENDEZVOUS_PORT, "The UDP port to listen on")
+	flag.Usage = func() { fmt.Println(usage) }
+	flag.Parse()
+
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatal("%s", err)
+	}
+	defer conn.Close()
+
+	err = app.NewRendezvousServer().Serve(conn)
+	if err != nil {
+		log.Fatal("%s", err)
+	}
+}
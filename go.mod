@@ -3,15 +3,27 @@ module github.com/NikosGour/BigDownloadP2P
 go 1.24.2
 
 require (
-	github.com/NikosGour/logging v0.1.6 // indirect
+	filippo.io/edwards25519 v1.2.0
+	github.com/NikosGour/logging v0.1.6
+	github.com/cespare/xxhash/v2 v2.3.0
+	github.com/gen2brain/raylib-go/raylib v0.55.1
+	github.com/google/uuid v1.6.0
+	github.com/hashicorp/yamux v0.1.2
+	github.com/klauspost/compress v1.18.0
+	github.com/orcaman/concurrent-map/v2 v2.0.1
+	github.com/quic-go/quic-go v0.59.1
+	github.com/zeebo/blake3 v0.2.4
+	golang.org/x/sys v0.35.0
+)
+
+require (
 	github.com/ebitengine/purego v0.8.4 // indirect
 	github.com/felixge/fgprof v0.9.3 // indirect
-	github.com/gen2brain/raylib-go/raylib v0.55.1 // indirect
 	github.com/google/pprof v0.0.0-20211214055906-6f57359322fd // indirect
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/orcaman/concurrent-map/v2 v2.0.1 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
 	github.com/pkg/profile v1.7.0 // indirect
 	gitlab.com/metakeule/fmtdate v1.2.2 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
 	golang.org/x/exp v0.0.0-20250718183923-645b1fa84792 // indirect
-	golang.org/x/sys v0.34.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
 )